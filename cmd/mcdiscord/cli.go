@@ -0,0 +1,202 @@
+package main // "github.com/itszuvalex/mcdiscord"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/control"
+	"github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+	"github.com/itszuvalex/mcdiscord/pkg/server"
+)
+
+const cliUsage = `usage:
+  mcdiscord servers list
+  mcdiscord servers add {host[:port]} {name}
+  mcdiscord servers rename {name} {new name}
+  mcdiscord servers move {name} {host[:port]}
+  mcdiscord servers tag {name} [tag...]
+  mcdiscord servers remove {name|host:port}
+  mcdiscord config get {path}
+  mcdiscord config set {path} {value}
+  mcdiscord config restore [n]
+  mcdiscord send {server|group:tag} {message}`
+
+// runCli sends a command to the running instance, falling back to editing the
+// config file directly if no instance is listening on the control socket.
+func runCli(args []string) int {
+	request := control.Request{Command: args[0], Args: args[1:]}
+	response, err := control.Send(SocketPath, request)
+	if err != nil && control.IsDialError(err) {
+		var output string
+		output, err = runOffline(request)
+		response = &control.Response{Output: output}
+	}
+	if err != nil {
+		fmt.Println("error:", err)
+		return 1
+	}
+
+	if response.Output != "" {
+		fmt.Println(response.Output)
+	}
+	if response.Error != "" {
+		fmt.Println("error:", response.Error)
+		return 1
+	}
+	return 0
+}
+
+func runOffline(request control.Request) (string, error) {
+	fields, err := mcdiscord.ReadConfigFile(ConfigFile)
+	if err != nil {
+		return "", err
+	}
+
+	switch request.Command {
+	case "servers":
+		return offlineServers(fields, request.Args)
+	case "config":
+		if len(request.Args) >= 1 && request.Args[0] == "restore" {
+			n, err := api.ParseBackup(request.Args[1:])
+			if err != nil {
+				return "", err
+			}
+			return "", mcdiscord.RestoreConfigFile(ConfigFile, n)
+		}
+		if len(request.Args) >= 2 && request.Args[0] == "get" {
+			value, err := mcdiscord.GetConfigPath(fields, request.Args[1])
+			return string(value), err
+		}
+		if len(request.Args) >= 3 && request.Args[0] == "set" {
+			if err = mcdiscord.SetOfflineConfigPath(fields, request.Args[1], strings.Join(request.Args[2:], " ")); err != nil {
+				return "", err
+			}
+			return "", mcdiscord.WriteConfigFile(ConfigFile, fields)
+		}
+	case "send":
+		return "", errors.New("send needs a running bot")
+	}
+	return "", errors.New(cliUsage)
+}
+
+// resolveLocation parses a location the way the running bot would with config.
+func resolveLocation(config server.ServerHandlerConfig, loc string) (*api.NetLocation, error) {
+	if config.LookupSrv {
+		return api.ResolveNetLocation(loc)
+	}
+	return api.ParseNetLocation(loc)
+}
+
+func offlineServers(fields map[string]json.RawMessage, args []string) (string, error) {
+	config := server.ServerHandlerConfig{Outbox: server.DefaultOutboxConfig()}
+	if data, ok := fields[server.ConfigKey]; ok {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return "", err
+		}
+	}
+	if len(args) < 1 {
+		return "", errors.New(cliUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		var lines []string
+		for _, s := range config.Servers {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s", s.Name, s.Location, api.Disconnected, strings.Join(s.Tags, ",")))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n"), nil
+	case "add":
+		if len(args) < 3 {
+			return "", errors.New(cliUsage)
+		}
+		location, err := resolveLocation(config, args[1])
+		if err != nil {
+			return "", err
+		}
+		name := strings.Join(args[2:], " ")
+		for _, s := range config.Servers {
+			if s.Location == *location {
+				return "", fmt.Errorf("Server at address %s already exists", location)
+			}
+			if s.Name == name {
+				return "", fmt.Errorf("Server of name %s already exists", name)
+			}
+		}
+		config.Servers = append(config.Servers, server.ServerConfig{Id: server.NewServerId(), Name: name, Location: *location})
+	case "rename":
+		return "", errors.New("servers rename needs a running bot, guild settings naming the server follow it")
+	case "move":
+		if len(args) < 3 {
+			return "", errors.New(cliUsage)
+		}
+		location, err := resolveLocation(config, args[len(args)-1])
+		if err != nil {
+			return "", err
+		}
+		name := strings.Join(args[1:len(args)-1], " ")
+		found := -1
+		for i, s := range config.Servers {
+			if s.Location == *location {
+				return "", fmt.Errorf("Server at address %s already exists", location)
+			}
+			if s.Name == name {
+				found = i
+			}
+		}
+		if found < 0 {
+			return "", fmt.Errorf("Could not find a server of name %s", name)
+		}
+		moved := &config.Servers[found]
+		if moved.Id == "" {
+			moved.Id = server.LocationServerId(moved.Location)
+		}
+		moved.Location = *location
+	case "tag":
+		if len(args) < 2 {
+			return "", errors.New(cliUsage)
+		}
+		found := false
+		for i, s := range config.Servers {
+			if s.Name == args[1] {
+				config.Servers[i].Tags = args[2:]
+				found = true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("Could not find a server of name %s", args[1])
+		}
+	case "remove":
+		if len(args) < 2 {
+			return "", errors.New(cliUsage)
+		}
+		target := strings.Join(args[1:], " ")
+		found := false
+		for i, s := range config.Servers {
+			if s.Name == target || s.Location.String() == target {
+				config.Servers = append(config.Servers[:i], config.Servers[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("Could not find a server of name %s", target)
+		}
+	default:
+		return "", errors.New(cliUsage)
+	}
+
+	data, err := json.Marshal(&config)
+	if err != nil {
+		return "", err
+	}
+	if err = server.ValidateConfig(data); err != nil {
+		return "", err
+	}
+	fields[server.ConfigKey] = data
+	return "", mcdiscord.WriteConfigFile(ConfigFile, fields)
+}
@@ -1,6 +1,7 @@
 package main // "github.com/itszuvalex/mcdiscord"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,17 +11,38 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/itszuvalex/mcdiscord/pkg/control"
 	"github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+	"github.com/itszuvalex/mcdiscord/pkg/mctest"
 )
 
 const (
 	ConfigFolder = "config"
 )
 
+// stringList collects every occurrence of a repeatable flag.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 var (
 	Token, TokenFile string
+	ConfigOverrides  stringList
+	ConfigFile       string
+	SocketPath       string
 	Port             int
+	TestServer       bool
+	ShutdownTimeout  time.Duration
+	WatchInterval    time.Duration
 )
 
 func RootPath() string {
@@ -38,38 +60,93 @@ func ConfigPath() string {
 func init() {
 	flag.StringVar(&Token, "t", "", "Bot Token")
 	flag.StringVar(&TokenFile, "tf", filepath.Join(ConfigPath(), "Token.txt"), "File containing bot Token")
+	flag.StringVar(&ConfigFile, "config", filepath.Join(ConfigPath(), "config.json"), "Config file")
+	flag.Var(&ConfigOverrides, "set", "Override a config value, path=value, may be repeated")
+	flag.StringVar(&SocketPath, "sock", filepath.Join(ConfigPath(), "mcdiscord.sock"), "Control socket used by the command line")
 	flag.IntVar(&Port, "p", 3553, "Test Port")
+	flag.BoolVar(&TestServer, "test", false, "Run a fake Minecraft server on the test port")
+	flag.DurationVar(&WatchInterval, "watch", 5*time.Second, "How often to check the config file for changes, 0 to disable")
+	flag.DurationVar(&ShutdownTimeout, "st", 10*time.Second, "Time allowed to flush chat and disconnect on shutdown")
 	flag.Parse()
 
+	if Token == "" {
+		Token = os.Getenv(mcdiscord.EnvPrefix + "TOKEN")
+	}
 	if Token == "" && TokenFile == "" {
-		fmt.Errorf("Missing token and tokenFile")
+		fmt.Println("Missing token and tokenFile")
 	}
 }
 
 func main() {
+	if flag.NArg() > 0 {
+		os.Exit(runCli(flag.Args()))
+	}
+
 	if Token == "" {
 		data, err := ioutil.ReadFile(TokenFile)
 		if err != nil {
-			fmt.Errorf("Error reading Token File", err)
+			fmt.Println("Error reading Token File,", err)
 		}
 		Token = strings.TrimSpace(string(data))
 	}
 
-	dg, err := mcdiscord.New(Token, filepath.Join(ConfigPath(), "config.json"))
+	dg, err := mcdiscord.New(Token, ConfigFile,
+		mcdiscord.EnvLayer(mcdiscord.EnvPrefix, os.Environ()),
+		mcdiscord.FlagLayer(ConfigOverrides))
 	if err != nil {
 		fmt.Println("error creating McDiscord, ", err)
 		return
 	}
 
-	err = dg.Open()
+	if TestServer {
+		test, err := mctest.NewServer(Port)
+		if err != nil {
+			fmt.Println("error creating test server, ", err)
+			return
+		}
+		test.Start()
+		defer test.Close()
+		fmt.Println(fmt.Sprintf("Test server listening on %s", test.Location()))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dg.WatchInterval = WatchInterval
+	err = dg.Open(ctx)
 	if err != nil {
 		fmt.Println("error opening connection, ", err)
 		return
 	}
-	defer dg.Close()
+
+	controlServer := control.NewServer(SocketPath, dg.HandleControl)
+	if err = controlServer.Start(); err != nil {
+		fmt.Println("error starting control socket, ", err)
+	} else {
+		defer controlServer.Close()
+	}
 
 	fmt.Println("Bot is now running.  Press CTRL-C to exit.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
-	<-sc
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case <-hup:
+			if err := dg.Config.Reload(); err != nil {
+				fmt.Println(err)
+			}
+		case <-sc:
+			break wait
+		}
+	}
+
+	fmt.Println("Shutting down.")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer shutdownCancel()
+	for _, err := range dg.Close(shutdownCtx) {
+		fmt.Println("error during shutdown, ", err)
+	}
 }
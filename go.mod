@@ -4,6 +4,8 @@ go 1.12
 
 require (
 	github.com/bwmarrin/discordgo v0.19.0
+	github.com/wcharczuk/go-chart/v2 v2.1.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980
 	golang.org/x/tools v0.0.0-20190613204242-ed0dc450797f // indirect
 )
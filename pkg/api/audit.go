@@ -0,0 +1,26 @@
+package api // "github.com/itszuvalex/mcdiscord/pkg/api"
+
+import "time"
+
+// AuditEntry records one administrative action and how it turned out.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	UserId  string    `json:"userId,omitempty"`
+	User    string    `json:"user"`
+	GuildId string    `json:"guildId,omitempty"`
+	Command string    `json:"command"`
+	Args    string    `json:"args,omitempty"`
+	Server  string    `json:"server,omitempty"`
+	Result  string    `json:"result"`
+}
+
+type AuditHandler func(entry AuditEntry)
+
+// IAuditLog is an append-only record of administrative actions. It must be safe for concurrent use.
+type IAuditLog interface {
+	Append(entry AuditEntry) error
+	// Recent returns up to n of the latest entries, oldest first.
+	Recent(n int) ([]AuditEntry, error)
+	// AddHandler registers handler to see every entry as it is appended.
+	AddHandler(handler AuditHandler)
+}
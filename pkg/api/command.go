@@ -0,0 +1,107 @@
+package api // "github.com/itszuvalex/mcdiscord/pkg/api"
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultDeniedCommands can never be run from Discord, whatever a role allows.
+var DefaultDeniedCommands = []string{
+	"op", "deop", "stop", "ban", "ban-ip", "pardon", "pardon-ip", "whitelist",
+	"save-off", "reload", "execute", "function", "debug",
+}
+
+// CommandAudit records a console command that was sent, or refused.
+type CommandAudit struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Source  string    `json:"source"`
+	Allowed bool      `json:"allowed"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+// CommandAuditHandler receives every console command sent from a command, or refused.
+type CommandAuditHandler func(entry CommandAudit)
+
+// SanitizeText removes newlines and other control characters, which a console would
+// otherwise treat as the end of one command and the start of the next.
+func SanitizeText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, text)
+}
+
+// SayText is SanitizeText for text sent with say, which also resolves target selectors such
+// as @a or @e. A zero width space after every @ keeps them from being read as selectors.
+func SayText(text string) string {
+	return strings.Replace(SanitizeText(text), "@", "@\u200b", -1)
+}
+
+// CheckCommand rejects a command that could run more than one console command.
+func CheckCommand(command string) error {
+	if strings.TrimSpace(command) == "" {
+		return errors.New("Command is empty")
+	}
+	if strings.IndexFunc(command, unicode.IsControl) >= 0 {
+		return errors.New("Command contains control characters")
+	}
+	return nil
+}
+
+// CommandName returns the bare name of a console command, without a leading slash or namespace.
+func CommandName(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimPrefix(fields[0], "/"))
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// CommandPolicy decides which console commands may be run from Discord.
+type CommandPolicy struct {
+	// Denied names commands that are always refused.
+	Denied []string
+	// Allowed holds patterns a command must match, * matching any text, e.g. "time set *".
+	Allowed []string
+}
+
+// Check returns nil if command is allowed by the policy.
+func (policy CommandPolicy) Check(command string) error {
+	if err := CheckCommand(command); err != nil {
+		return err
+	}
+	name := CommandName(command)
+	for _, denied := range policy.Denied {
+		if strings.EqualFold(name, denied) {
+			return fmt.Errorf("Command %s is denied", name)
+		}
+	}
+	command = strings.TrimPrefix(strings.TrimSpace(command), "/")
+	for _, pattern := range policy.Allowed {
+		if MatchCommand(pattern, command) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Command %s is not allowed", name)
+}
+
+// MatchCommand reports whether command matches pattern, where * matches any text.
+func MatchCommand(pattern string, command string) bool {
+	parts := strings.Split(strings.TrimPrefix(pattern, "/"), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	matched, err := regexp.MatchString("(?i)^"+strings.Join(parts, ".*")+"$", command)
+	return err == nil && matched
+}
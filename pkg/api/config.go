@@ -1,13 +1,145 @@
 package api // "github.com/itszuvalex/mcdiscord/pkg/api"
 
-import "encoding/json"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type ConfigReadHandler func(data json.RawMessage) error
 type ConfigWriteHandler func() (json.RawMessage, error)
 
+// ConfigValidateHandler checks a key's json before it is written to disk.
+type ConfigValidateHandler func(data json.RawMessage) error
+
+// ConfigOption describes a single value that can be changed at runtime, e.g. from Discord.
+type ConfigOption struct {
+	Path        string
+	Description string
+	Default     string
+	// Parse turns user input into the option's json, rejecting invalid values.
+	Parse func(value string) (json.RawMessage, error)
+}
+
+// StringOption accepts any string that passes validate, which may be nil.
+func StringOption(path string, description string, def string, validate func(value string) error) ConfigOption {
+	return ConfigOption{
+		Path:        path,
+		Description: description,
+		Default:     def,
+		Parse: func(value string) (json.RawMessage, error) {
+			if validate != nil {
+				if err := validate(value); err != nil {
+					return nil, err
+				}
+			}
+			return json.Marshal(value)
+		},
+	}
+}
+
+// IntOption accepts whole numbers between min and max inclusive.
+func IntOption(path string, description string, def int, min int, max int) ConfigOption {
+	return ConfigOption{
+		Path:        path,
+		Description: description,
+		Default:     strconv.Itoa(def),
+		Parse: func(value string) (json.RawMessage, error) {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a whole number", path)
+			}
+			if i < min || i > max {
+				return nil, fmt.Errorf("%s must be between %d and %d", path, min, max)
+			}
+			return json.Marshal(i)
+		},
+	}
+}
+
+// BoolOption accepts true or false.
+func BoolOption(path string, description string, def bool) ConfigOption {
+	return ConfigOption{
+		Path:        path,
+		Description: description,
+		Default:     strconv.FormatBool(def),
+		Parse: func(value string) (json.RawMessage, error) {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be true or false", path)
+			}
+			return json.Marshal(b)
+		},
+	}
+}
+
+// EnumOption accepts only one of values.
+func EnumOption(path string, description string, def string, values ...string) ConfigOption {
+	return StringOption(path, description, def, func(value string) error {
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s", path, strings.Join(values, ", "))
+	})
+}
+
+// ListOption accepts a comma separated list, checking each item with validate, which may be nil.
+func ListOption(path string, description string, validate func(item string) error) ConfigOption {
+	return ConfigOption{
+		Path:        path,
+		Description: description,
+		Parse: func(value string) (json.RawMessage, error) {
+			items := []string{}
+			for _, item := range strings.Split(value, ",") {
+				item = strings.TrimSpace(item)
+				if item == "" {
+					continue
+				}
+				if validate != nil {
+					if err := validate(item); err != nil {
+						return nil, err
+					}
+				}
+				items = append(items, item)
+			}
+			return json.Marshal(items)
+		},
+	}
+}
+
+// ParseBackup reads an optional backup number, defaulting to the most recent.
+func ParseBackup(args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid backup number %s", args[0])
+	}
+	return n, nil
+}
+
 type IConfig interface {
 	AddReadHandler(key string, handler ConfigReadHandler)
 	AddWriteHandler(key string, handler ConfigWriteHandler)
+	AddValidateHandler(key string, handler ConfigValidateHandler)
+	AddOption(option ConfigOption)
+	// Option looks up a registered option by path, Options lists them sorted by path.
+	Option(path string) (ConfigOption, bool)
+	Options() []ConfigOption
 	Read() error
 	Write() error
+	// Reload re-reads the config at runtime, keeping the current config if the file is invalid.
+	Reload() error
+	Watch(ctx context.Context, interval time.Duration)
+	// Restore replaces the config with backup n, 1 being the most recent.
+	Restore(n int) error
+	// Get and Set address values by dotted path, e.g. "discord.controlChar".
+	Get(path string) (json.RawMessage, error)
+	Set(path string, value json.RawMessage) error
 }
@@ -1,9 +1,22 @@
 package api // "github.com/itszuvalex/mcdiscord/pkg/api"
 
+import "context"
+
+// OfflineNotice is posted to Discord and the servers when the bot shuts down.
+const OfflineNotice = "Discord Bot: Going offline."
+
 type IDiscordHandler interface {
 	ChatInput() chan MessageWithSender
 	ChatOutput() chan MessageWithSender
 	SetServerHandler(handler IServerHandler)
-	Open() error
-	Close() error
+	SetAuditLog(log IAuditLog)
+	SetCommandAudit(handler CommandAuditHandler)
+	SetChatHistory(history IChatHistory)
+	SetPlayerSessions(sessions IPlayerSessions)
+	SetStatusHistory(history IStatusHistory)
+	CheckAlerts(server IServer, status McServerData)
+	// RenameServer updates settings that name a server, it is a RenameHandler.
+	RenameServer(oldName string, newName string)
+	Open(ctx context.Context) error
+	Close(ctx context.Context) error
 }
@@ -0,0 +1,39 @@
+package api // "github.com/itszuvalex/mcdiscord/pkg/api"
+
+import "time"
+
+// ChatRecord is one relayed chat message. Messages from the game have a Player, messages
+// from Discord a DiscordUser, Servers lists the IDs of the servers the message was seen on.
+type ChatRecord struct {
+	Time          time.Time `json:"time"`
+	Servers       []string  `json:"servers"`
+	Player        string    `json:"player,omitempty"`
+	DiscordUser   string    `json:"discordUser,omitempty"`
+	DiscordUserId string    `json:"discordUserId,omitempty"`
+	GuildId       string    `json:"guildId,omitempty"`
+	Message       string    `json:"message"`
+}
+
+// ChatQuery selects records, empty fields match everything.
+type ChatQuery struct {
+	// Server is a server ID.
+	Server string
+	Player string
+	Since  time.Time
+	// Text matches messages containing it, ignoring case.
+	Text string
+	// Filter, if set, must also accept a record.
+	Filter func(record ChatRecord) bool
+	Limit  int
+}
+
+// IChatHistory stores relayed chat. It must be safe for concurrent use.
+type IChatHistory interface {
+	Add(record ChatRecord) error
+	// Query returns up to Limit of the newest matching records, oldest first.
+	Query(query ChatQuery) ([]ChatRecord, error)
+	// AdoptServerIds moves data stored under server names, from before servers had IDs,
+	// to the IDs ids maps the names to.
+	AdoptServerIds(ids map[string]string) error
+	Close() error
+}
@@ -38,6 +38,8 @@ type Message struct {
 
 type Command struct {
 	Command string `json:"cmd"`
+	// Source says who asked for the command, for the audit log. It is not sent to the server.
+	Source string `json:"-"`
 }
 
 type JsonMessageHandler func(interface{}) error
@@ -194,7 +196,12 @@ func MarshallCommand(command *Command) ([]byte, error) {
 	return commanddata, err
 }
 
+// MarshalCommandToHeader is the single way commands reach a server, so every command is
+// checked here.
 func MarshalCommandToHeader(command *Command, header *Header) error {
+	if err := CheckCommand(command.Command); err != nil {
+		return err
+	}
 	header.Type = CommandType
 	commandData, err := MarshallCommand(command)
 	if err != nil {
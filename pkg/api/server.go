@@ -1,8 +1,28 @@
 package api // "github.com/itszuvalex/mcdiscord/pkg/api"
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
 type MessageWithSender struct {
 	Message string
 	Sender  string
+	// SenderId and SenderTag identify a Discord sender, the tag being the full name#0000.
+	SenderId  string
+	SenderTag string
+	// Server names the server a message came from, if any, ServerId identifies it.
+	Server   string
+	ServerId string
+	// GuildId, ChannelId and MessageId identify the Discord message this came from, if any.
+	GuildId   string
+	ChannelId string
+	MessageId string
 }
 
 // State exists because Go doesn't have enums for some reason.
@@ -25,24 +45,183 @@ const (
 	Connected    ConnectionStatus = 2
 )
 
+func (status ConnectionStatus) String() string {
+	switch status {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	}
+	return "unknown"
+}
+
+// DeliveryStatus describes what happened to a packet sent to a single server.
+type DeliveryStatus int
+
+const (
+	// Delivered indicates the packet was written to the server's connection.
+	Delivered DeliveryStatus = 0
+	// Queued indicates the packet is waiting in the server's outbox. It may still be dropped
+	// later, if the outbox overflows under the oldest drop policy or the packet expires, which
+	// is logged but cannot change a result already reported.
+	Queued DeliveryStatus = 1
+	// Dropped indicates the packet was discarded because the outbox was full.
+	Dropped DeliveryStatus = 2
+)
+
+func (status DeliveryStatus) String() string {
+	switch status {
+	case Delivered:
+		return "delivered"
+	case Queued:
+		return "queued"
+	case Dropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// PendingDelivery waits a short while for a queued packet to leave the outbox and
+// returns what became of it, Queued if it is still waiting.
+type PendingDelivery func() DeliveryStatus
+
+// PendingSummary waits for the packets of a broadcast that was queued without waiting.
+type PendingSummary func() DeliverySummary
+
+type DeliveryResult struct {
+	Location NetLocation
+	Id       string
+	Name     string
+	Status   DeliveryStatus
+	Err      error
+}
+
+// DeliverySummary collects the per-server results of a broadcast.
+type DeliverySummary struct {
+	Results []DeliveryResult
+}
+
+func (summary DeliverySummary) Count(status DeliveryStatus) int {
+	count := 0
+	for _, result := range summary.Results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Missed returns true if any server did not receive the packet immediately.
+func (summary DeliverySummary) Missed() bool {
+	return summary.Count(Delivered) != len(summary.Results)
+}
+
 type NetLocation struct {
 	Address string `json:"address"`
 	Port    int    `json:"port"`
 }
 
+// String is the location as host:port, with IPv6 hosts in brackets.
+func (location NetLocation) String() string {
+	return net.JoinHostPort(location.Address, strconv.Itoa(location.Port))
+}
+
+// IServerHandler implementations must be safe for concurrent use, Servers returns a snapshot.
 type IServerHandler interface {
+	// AddServer adds a server under a new ID, names must be unique.
 	AddServer(address NetLocation, name string) error
 	RemoveServer(address NetLocation) error
 	RemoveServerByName(name string) error
-	SendPacketToAllServers(header Header)
+	// RenameServer and MoveServer keep the server's ID, RenameHandlers are told of new names.
+	RenameServer(name string, newName string) error
+	MoveServer(name string, address NetLocation) error
+	// ResolveLocation parses a host[:port] given by a user, looking up a SRV record for
+	// the port if that is configured, see ResolveNetLocation.
+	ResolveLocation(loc string) (*NetLocation, error)
+	AddRenameHandler(handler RenameHandler)
+	SendPacketToAllServers(header Header) DeliverySummary
+	// SendPacketToServers delivers header to the servers named by targets, see MatchesTarget.
+	SendPacketToServers(header Header, targets []string) DeliverySummary
+	// QueuePacketToAllServers and QueuePacketToServers hand header to the outboxes without
+	// waiting for delivery. They return the servers as queued or dropped, and a PendingSummary
+	// that waits for the deliveries.
+	QueuePacketToAllServers(header Header) (DeliverySummary, PendingSummary)
+	QueuePacketToServers(header Header, targets []string) (DeliverySummary, PendingSummary)
+	SetServerTags(name string, tags []string) error
+	// AddStatusHandler registers handler for status pushes from every server, it must return quickly.
+	AddStatusHandler(handler StatusHandler)
 	Servers() map[NetLocation]IServer
-	Close() []error
+	Open(ctx context.Context) error
+	Close(ctx context.Context) []error
 }
 
 type IServer interface {
+	// Id stays the same for the life of the server, through renames and moves.
+	Id() string
 	Location() NetLocation
 	Name() string
-	StartConnectLoop() error
-	Close() error
-	JsonChan() chan Header
+	SetName(name string)
+	Status() ConnectionStatus
+	StartConnectLoop(ctx context.Context) error
+	Close(ctx context.Context) error
+	// Send queues header and waits a short while for it to be delivered.
+	Send(header Header) (DeliveryStatus, error)
+	// Queue hands header to the outbox without waiting, in the order Queue is called.
+	Queue(header Header) (PendingDelivery, error)
+	// Data returns the latest status the server pushed.
+	Data() McServerData
+	// Tags are the groups the server belongs to, e.g. modded or event.
+	Tags() []string
+	SetTags(tags []string)
 }
+
+// GroupPrefix marks a target naming every server tagged with a group, e.g. group:modded.
+const GroupPrefix = "group:"
+
+// ValidateServerName rejects names that would be taken for a group target.
+func ValidateServerName(name string) error {
+	if name == "" {
+		return errors.New("Server name must not be empty")
+	}
+	if strings.HasPrefix(name, GroupPrefix) {
+		return fmt.Errorf("Server name %s must not start with %s", name, GroupPrefix)
+	}
+	return nil
+}
+
+// MatchesTarget reports whether target names server, either by its name or as group:<tag>.
+func MatchesTarget(name string, tags []string, target string) bool {
+	if target == name {
+		return true
+	}
+	if !strings.HasPrefix(target, GroupPrefix) {
+		return false
+	}
+	group := strings.TrimPrefix(target, GroupPrefix)
+	for _, tag := range tags {
+		if strings.EqualFold(tag, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTag rejects tags that could not be written as a group:<tag> target or in a list.
+func ValidateTag(tag string) error {
+	if tag == "" {
+		return errors.New("Tag must not be empty")
+	}
+	if strings.IndexFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == ',' || r == ':' }) >= 0 {
+		return fmt.Errorf("Tag %s must not contain spaces, commas or colons", tag)
+	}
+	return nil
+}
+
+// StatusHandler is called with every status a server pushes.
+type StatusHandler func(server IServer, status McServerData)
+
+// RenameHandler is called after a server is renamed, so settings that name it can follow.
+// It may be called while the config is being read, so it must not write the config.
+type RenameHandler func(oldName string, newName string)
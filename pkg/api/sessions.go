@@ -0,0 +1,35 @@
+package api // "github.com/itszuvalex/mcdiscord/pkg/api"
+
+import "time"
+
+// PlayerTime is the time a player spent online. Servers are given by ID here and below.
+type PlayerTime struct {
+	Player string
+	Server string
+	Time   time.Duration
+}
+
+// PlayerSeen is when and where a player was last online.
+type PlayerSeen struct {
+	Player string
+	Server string
+	Time   time.Time
+	Online bool
+}
+
+// IPlayerSessions derives play sessions from the player lists servers push. It must be
+// safe for concurrent use.
+type IPlayerSessions interface {
+	Update(server string, players []string, now time.Time) error
+	// Playtime returns a player's time per server since a time, zero meaning all time.
+	Playtime(player string, since time.Time) ([]PlayerTime, error)
+	// Top returns the n players with the most time since a time, on server or on all of
+	// them if server is empty. Servers rejected by filter are left out.
+	Top(server string, since time.Time, n int, filter func(server string) bool) ([]PlayerTime, error)
+	// Seen returns where a player was last online, leaving out servers rejected by filter.
+	Seen(player string, filter func(server string) bool) (*PlayerSeen, error)
+	// AdoptServerIds moves data stored under server names, from before servers had IDs,
+	// to the IDs ids maps the names to.
+	AdoptServerIds(ids map[string]string) error
+	Close() error
+}
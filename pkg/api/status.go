@@ -0,0 +1,23 @@
+package api // "github.com/itszuvalex/mcdiscord/pkg/api"
+
+import "time"
+
+// StatusSample is the part of a server's status kept for graphs.
+type StatusSample struct {
+	Time      time.Time       `json:"time"`
+	Tps       map[int]float32 `json:"tps"`
+	Players   int             `json:"players"`
+	Memory    int             `json:"memory"`
+	MemoryMax int             `json:"memoryMax"`
+}
+
+// IStatusHistory samples the status servers push, by server ID. It must be safe for concurrent use.
+type IStatusHistory interface {
+	Add(server string, status McServerData, now time.Time) error
+	// Query returns the samples of server taken since a time, oldest first.
+	Query(server string, since time.Time) ([]StatusSample, error)
+	// AdoptServerIds moves data stored under server names, from before servers had IDs,
+	// to the IDs ids maps the names to.
+	AdoptServerIds(ids map[string]string) error
+	Close() error
+}
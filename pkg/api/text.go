@@ -0,0 +1,68 @@
+package api // "github.com/itszuvalex/mcdiscord/pkg/api"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TextComponent is a Minecraft JSON text component, as taken by tellraw.
+type TextComponent struct {
+	Text       string          `json:"text"`
+	Color      string          `json:"color,omitempty"`
+	Bold       bool            `json:"bold,omitempty"`
+	HoverEvent *HoverEvent     `json:"hoverEvent,omitempty"`
+	Extra      []TextComponent `json:"extra,omitempty"`
+}
+
+// HoverEvent shows text when the component is hovered. Value is read by older servers,
+// Contents by 1.16 and later.
+type HoverEvent struct {
+	Action   string `json:"action"`
+	Value    string `json:"value"`
+	Contents string `json:"contents"`
+}
+
+func ShowText(text string) *HoverEvent {
+	return &HoverEvent{Action: "show_text", Value: text, Contents: text}
+}
+
+// McColors are the color names Minecraft understands, "#rrggbb" is accepted as well from 1.16.
+var McColors = []string{
+	"black", "dark_blue", "dark_green", "dark_aqua", "dark_red", "dark_purple", "gold", "gray",
+	"dark_gray", "blue", "green", "aqua", "red", "light_purple", "yellow", "white",
+}
+
+func ValidMcColor(color string) bool {
+	if len(color) == 7 && color[0] == '#' {
+		for _, c := range color[1:] {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, name := range McColors {
+		if name == color {
+			return true
+		}
+	}
+	return false
+}
+
+// PlainText strips the section sign formatting codes Minecraft would otherwise apply
+// inside a text component.
+func PlainText(text string) string {
+	return strings.Replace(text, "§", "", -1)
+}
+
+// TellrawCommand builds a tellraw command for target from components. Text in a component is
+// never parsed as a selector or command, json.Marshal takes care of quoting.
+func TellrawCommand(target string, components []TextComponent) (Command, error) {
+	// The first element of a list styles the rest, so lead with an empty one.
+	data, err := json.Marshal(append([]TextComponent{{}}, components...))
+	if err != nil {
+		return Command{}, err
+	}
+	return Command{Command: fmt.Sprintf("tellraw %s %s", target, data)}, nil
+}
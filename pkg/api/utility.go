@@ -1,22 +1,96 @@
 package api // "github.com/itszuvalex/mcdiscord/pkg/api"
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// DefaultPort is used for locations given without a port, it is the port the mod listens on by default.
+const DefaultPort = 3553
+
+// SrvLookupTimeout bounds the SRV lookup of ResolveNetLocation.
+const SrvLookupTimeout = 5 * time.Second
+
+// ParseNetLocation reads host[:port], IPv6 hosts with a port go in brackets as in [::1]:3553.
+// Without a port DefaultPort is used.
 func ParseNetLocation(loc string) (*NetLocation, error) {
-	location := NetLocation{}
-	ipport := strings.Split(loc, ":")
-	if len(ipport) != 2 {
-		return nil, fmt.Errorf("%s not a valid ip:port string", loc)
+	host, port, err := splitNetLocation(loc)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = DefaultPort
 	}
-	location.Address = ipport[0]
-	port, err := strconv.Atoi(ipport[1])
+	return &NetLocation{Address: host, Port: port}, nil
+}
+
+// ResolveNetLocation is ParseNetLocation that, for a location given without a port, first
+// looks for a _minecraft._tcp SRV record of the host. DefaultPort is used if there is none.
+func ResolveNetLocation(loc string) (*NetLocation, error) {
+	host, port, err := splitNetLocation(loc)
 	if err != nil {
 		return nil, err
 	}
-	location.Port = port
-	return &location, nil
+	if port != 0 {
+		return &NetLocation{Address: host, Port: port}, nil
+	}
+	if net.ParseIP(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), SrvLookupTimeout)
+		defer cancel()
+		if _, records, err := net.DefaultResolver.LookupSRV(ctx, "minecraft", "tcp", host); err == nil && len(records) > 0 {
+			return &NetLocation{Address: strings.TrimSuffix(records[0].Target, "."), Port: int(records[0].Port)}, nil
+		}
+	}
+	return &NetLocation{Address: host, Port: DefaultPort}, nil
+}
+
+// splitNetLocation splits loc into its host and port, port is 0 if loc has none.
+func splitNetLocation(loc string) (string, int, error) {
+	loc = strings.TrimSpace(loc)
+	host, portText, err := net.SplitHostPort(loc)
+	if err != nil {
+		// A bare host, or a bare IPv6 address, which has too many colons to carry a port.
+		host = loc
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", 0, fmt.Errorf("%s is not a valid host[:port]", loc)
+		}
+		portText = ""
+	} else if portText == "" {
+		// host: with nothing after the colon.
+		return "", 0, fmt.Errorf("%s is not a valid host[:port]", loc)
+	}
+	if host == "" || strings.ContainsAny(host, " /[]") {
+		return "", 0, fmt.Errorf("%s is not a valid host[:port]", loc)
+	}
+	if portText == "" {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("%s is not a port between 1 and 65535", portText)
+	}
+	return host, port, nil
+}
+
+// WaitContext waits for wg, giving up with ctx's error if ctx is done first.
+func WaitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,100 @@
+package audit // "github.com/itszuvalex/mcdiscord/pkg/audit"
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	FileName = "audit.jsonl"
+)
+
+var _ api.IAuditLog = (*Log)(nil)
+
+// Log appends audit entries to a file as one json object per line. The file is only ever
+// appended to, entries are never rewritten or removed.
+type Log struct {
+	File     string
+	handlers []api.AuditHandler
+	mutex    sync.Mutex
+}
+
+func NewLog(file string) *Log {
+	return &Log{File: file}
+}
+
+func (log *Log) AddHandler(handler api.AuditHandler) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.handlers = append(log.handlers, handler)
+}
+
+func (log *Log) Append(entry api.AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	log.mutex.Lock()
+	err = log.write(append(data, '\n'))
+	handlers := log.handlers
+	log.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(entry)
+	}
+	return err
+}
+
+func (log *Log) write(line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(log.File), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(log.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (log *Log) Recent(n int) ([]api.AuditEntry, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	file, err := os.Open(log.File)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []api.AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry api.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line from a crash should not hide everything before it.
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > n {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,136 @@
+package control // "github.com/itszuvalex/mcdiscord/pkg/control"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DialTimeout = 2 * time.Second
+	SocketMode  = 0600
+)
+
+// Request is a single CLI invocation, e.g. Command "servers" with Args ["list"].
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type Response struct {
+	Output string `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Handler func(request Request) Response
+
+// Server accepts control requests from the CLI on a local unix socket.
+type Server struct {
+	Path     string
+	handler  Handler
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+func NewServer(path string, handler Handler) *Server {
+	return &Server{Path: path, handler: handler}
+}
+
+func (server *Server) Start() error {
+	// A socket file left behind by a crashed instance would make Listen fail.
+	if _, err := os.Stat(server.Path); err == nil {
+		if conn, err := net.DialTimeout("unix", server.Path, DialTimeout); err == nil {
+			conn.Close()
+			return fmt.Errorf("Another instance is already listening on %s", server.Path)
+		}
+		os.Remove(server.Path)
+	}
+
+	listener, err := net.Listen("unix", server.Path)
+	if err != nil {
+		return err
+	}
+	// The socket can change servers and config, so only the bot's own user may connect.
+	if err = os.Chmod(server.Path, SocketMode); err != nil {
+		listener.Close()
+		return err
+	}
+	server.listener = listener
+
+	server.wg.Add(1)
+	go server.accept()
+	return nil
+}
+
+func (server *Server) Close() error {
+	if server.listener == nil {
+		return nil
+	}
+	err := server.listener.Close()
+	server.wg.Wait()
+	return err
+}
+
+func (server *Server) accept() {
+	defer server.wg.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.wg.Add(1)
+		go server.handle(conn)
+	}
+}
+
+func (server *Server) handle(conn net.Conn) {
+	defer server.wg.Done()
+	defer conn.Close()
+
+	var request Request
+	if err := json.NewDecoder(conn).Decode(&request); err != nil {
+		fmt.Println("Error decoding control request,", err)
+		return
+	}
+	fmt.Println("Received control command:", request.Command, request.Args)
+	response := server.handler(request)
+	if err := json.NewEncoder(conn).Encode(&response); err != nil {
+		fmt.Println("Error encoding control response,", err)
+	}
+}
+
+// Send delivers request to the instance listening on path. A dial error means
+// no instance is running.
+func Send(path string, request Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", path, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = json.NewEncoder(conn).Encode(&request); err != nil {
+		return nil, err
+	}
+	var response Response
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// IsDialError reports whether err means no instance is listening, the socket is missing or
+// refuses connections. Other errors, such as being denied the socket, do not count.
+func IsDialError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok || opErr.Op != "dial" {
+		return false
+	}
+	if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+		return sysErr.Err == syscall.ENOENT || sysErr.Err == syscall.ECONNREFUSED
+	}
+	return false
+}
@@ -0,0 +1,385 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	MetricTps    = "tps"
+	MetricMemory = "memory"
+	// AnyServer in a rule matches every server.
+	AnyServer = "*"
+)
+
+// AlertRule fires when a metric of a server stays past a threshold for a while.
+type AlertRule struct {
+	// Server is the server or group:<tag> the rule watches, * for all of them. Rules added
+	// with !alert keep a server by ID, so they follow it through renames.
+	Server string `json:"server"`
+	// Metric is tps, of one dimension, or memory, in percent of the maximum.
+	Metric    string  `json:"metric"`
+	Dimension int     `json:"dimension"`
+	Below     bool    `json:"below"`
+	Threshold float64 `json:"threshold"`
+	// ForSeconds is how long the threshold must be crossed before the alert fires.
+	ForSeconds int `json:"forSeconds"`
+}
+
+// AlertConfig holds the alert rules and how often one may fire again after recovering.
+type AlertConfig struct {
+	Rules           []AlertRule `json:"rules"`
+	CooldownSeconds int         `json:"cooldownSeconds"`
+}
+
+func DefaultAlertConfig() AlertConfig {
+	return AlertConfig{
+		Rules: []AlertRule{
+			{Server: AnyServer, Metric: MetricTps, Dimension: 0, Below: true, Threshold: 15, ForSeconds: 120},
+			{Server: AnyServer, Metric: MetricMemory, Threshold: 90, ForSeconds: 60},
+		},
+		CooldownSeconds: 600,
+	}
+}
+
+func alertOptions() []api.ConfigOption {
+	defaults := DefaultAlertConfig()
+	return []api.ConfigOption{
+		api.IntOption(ConfigKey+".alerts.cooldownSeconds", "Seconds before an alert that recovered may fire again.", defaults.CooldownSeconds, 0, 86400),
+	}
+}
+
+func (rule AlertRule) Validate() error {
+	if rule.Server == "" {
+		return errors.New("Alert rule needs a server, or * for all")
+	}
+	switch rule.Metric {
+	case MetricTps:
+	case MetricMemory:
+		if rule.Dimension != 0 {
+			return errors.New("Memory alerts have no dimension")
+		}
+	default:
+		return fmt.Errorf("Unknown alert metric %s, use tps or memory", rule.Metric)
+	}
+	if rule.ForSeconds < 0 {
+		return errors.New("Alert duration must not be negative")
+	}
+	return nil
+}
+
+// Matches reports whether the rule watches a server.
+func (rule AlertRule) Matches(server api.IServer) bool {
+	return rule.Server == AnyServer || rule.Server == server.Id() || api.MatchesTarget(server.Name(), server.Tags(), rule.Server)
+}
+
+// Value reads the rule's metric from a status, false if the status does not carry it.
+func (rule AlertRule) Value(status api.McServerData) (float64, bool) {
+	switch rule.Metric {
+	case MetricTps:
+		tps, ok := status.Tps[rule.Dimension]
+		return float64(tps), ok
+	case MetricMemory:
+		if status.MemoryMax <= 0 {
+			return 0, false
+		}
+		return float64(status.Memory) * 100 / float64(status.MemoryMax), true
+	}
+	return 0, false
+}
+
+// Crossed reports whether value is past the rule's threshold.
+func (rule AlertRule) Crossed(value float64) bool {
+	if rule.Below {
+		return value < rule.Threshold
+	}
+	return value > rule.Threshold
+}
+
+func (rule AlertRule) String() string {
+	op := ">"
+	if rule.Below {
+		op = "<"
+	}
+	text := fmt.Sprintf("%s %s %s %g", rule.Server, rule.metricName(), op, rule.Threshold)
+	if rule.ForSeconds > 0 {
+		text += " for " + (time.Duration(rule.ForSeconds) * time.Second).String()
+	}
+	return text
+}
+
+func (rule AlertRule) metricName() string {
+	if rule.Metric == MetricTps {
+		return dimensionName(rule.Dimension) + " tps"
+	}
+	return "memory %"
+}
+
+func dimensionName(dimension int) string {
+	switch dimension {
+	case 0:
+		return "overworld"
+	case -1:
+		return "nether"
+	case 1:
+		return "end"
+	}
+	return fmt.Sprintf("dimension %d", dimension)
+}
+
+// ParseAlertRule reads a rule as written to !alert add: {server|group:<tag>|*} {tps[:dimension]|memory} {<|>} {threshold} [duration].
+func ParseAlertRule(args []string) (AlertRule, error) {
+	if len(args) < 4 || len(args) > 5 {
+		return AlertRule{}, errors.New("Alert rule needs {server|group:<tag>|*} {tps[:dimension]|memory} {<|>} {threshold} [duration]")
+	}
+	rule := AlertRule{Server: args[0], Metric: args[1]}
+	if i := strings.Index(args[1], ":"); i >= 0 {
+		dimension, err := strconv.Atoi(args[1][i+1:])
+		if err != nil {
+			return AlertRule{}, fmt.Errorf("%s is not a dimension", args[1][i+1:])
+		}
+		rule.Metric, rule.Dimension = args[1][:i], dimension
+	}
+	switch args[2] {
+	case "<":
+		rule.Below = true
+	case ">":
+	default:
+		return AlertRule{}, fmt.Errorf("%s is not < or >", args[2])
+	}
+	threshold, err := strconv.ParseFloat(args[3], 64)
+	if err != nil {
+		return AlertRule{}, fmt.Errorf("%s is not a number", args[3])
+	}
+	rule.Threshold = threshold
+	if len(args) > 4 {
+		duration, err := time.ParseDuration(args[4])
+		if err != nil || duration < 0 {
+			return AlertRule{}, fmt.Errorf("%s is not a duration like 2m", args[4])
+		}
+		rule.ForSeconds = int(duration / time.Second)
+	}
+	return rule, rule.Validate()
+}
+
+// alertState tracks one rule on one server.
+type alertState struct {
+	serverId     string
+	rule         AlertRule
+	crossedSince time.Time
+	firing       bool
+	lastFired    time.Time
+}
+
+// alerter remembers which rules are crossed on which servers, by server ID.
+type alerter struct {
+	states map[string]*alertState
+	mutex  sync.Mutex
+}
+
+func newAlerter() *alerter {
+	return &alerter{states: make(map[string]*alertState)}
+}
+
+// alertEvent is an alert firing, or recovering if Recovered is set.
+type alertEvent struct {
+	Rule      AlertRule
+	Server    api.IServer
+	Value     float64
+	Recovered bool
+}
+
+// firingAlert is a rule that fired on a server and has not recovered yet.
+type firingAlert struct {
+	ServerId string
+	Rule     AlertRule
+}
+
+// Check updates the states for a status and returns the alerts that fire or recover because of it.
+func (a *alerter) Check(config AlertConfig, server api.IServer, status api.McServerData, now time.Time) []alertEvent {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cooldown := time.Duration(config.CooldownSeconds) * time.Second
+	var events []alertEvent
+	for _, rule := range config.Rules {
+		if !rule.Matches(server) {
+			continue
+		}
+		value, ok := rule.Value(status)
+		if !ok {
+			continue
+		}
+		// Keyed by the rule's text, so editing the rule list does not mix up states.
+		key := server.Id() + "|" + rule.String()
+		state, ok := a.states[key]
+		if !ok {
+			state = &alertState{serverId: server.Id(), rule: rule}
+			a.states[key] = state
+		}
+		if !rule.Crossed(value) {
+			state.crossedSince = time.Time{}
+			if state.firing {
+				state.firing = false
+				events = append(events, alertEvent{Rule: rule, Server: server, Value: value, Recovered: true})
+			}
+			continue
+		}
+		if state.crossedSince.IsZero() {
+			state.crossedSince = now
+		}
+		if state.firing || now.Sub(state.crossedSince) < time.Duration(rule.ForSeconds)*time.Second {
+			continue
+		}
+		if !state.lastFired.IsZero() && now.Sub(state.lastFired) < cooldown {
+			continue
+		}
+		state.firing, state.lastFired = true, now
+		events = append(events, alertEvent{Rule: rule, Server: server, Value: value})
+	}
+	return events
+}
+
+// Firing lists the alerts that have fired and not recovered yet.
+func (a *alerter) Firing() []firingAlert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var firing []firingAlert
+	for _, state := range a.states {
+		if state.firing {
+			firing = append(firing, firingAlert{ServerId: state.serverId, Rule: state.rule})
+		}
+	}
+	return firing
+}
+
+// CheckAlerts evaluates the alert rules against a status a server pushed, and posts alerts
+// and recoveries to the alert channel of every guild that sees the server.
+func (discord *DiscordHandler) CheckAlerts(server api.IServer, status api.McServerData) {
+	config := discord.currentConfig()
+	for _, event := range discord.alerts.Check(config.Alerts, server, status, time.Now()) {
+		for _, guild := range config.Guilds {
+			guild.findServer = discord.findServer
+			if guild.AlertChannel == "" || !guild.Sees(event.Server.Id()) {
+				continue
+			}
+			if _, err := discord.session.ChannelMessageSend(guild.AlertChannel, discord.formatAlert(event, guild.AlertRoles)); err != nil {
+				fmt.Println("Error posting alert,", err)
+			}
+		}
+	}
+}
+
+// ruleText shows a rule with the current name of the server it watches.
+func (discord *DiscordHandler) ruleText(rule AlertRule) string {
+	rule.Server = discord.serverName(rule.Server)
+	return rule.String()
+}
+
+func (discord *DiscordHandler) formatAlert(event alertEvent, roles []string) string {
+	if event.Recovered {
+		return fmt.Sprintf("%s %s recovered, %s is %.1f.", Emoji_Check, event.Server.Name(), event.Rule.metricName(), event.Value)
+	}
+	var mentions []string
+	for _, role := range roles {
+		mentions = append(mentions, "<@&"+role+">")
+	}
+	text := fmt.Sprintf("%s %s: %s is %.1f, alert %s.", Emoji_Warn, event.Server.Name(), event.Rule.metricName(), event.Value, discord.ruleText(event.Rule))
+	if len(mentions) > 0 {
+		text = strings.Join(mentions, " ") + " " + text
+	}
+	return text
+}
+
+// handleAlert dispatches !alert subcommands: list, add {rule} and rm {number}.
+func (discord *DiscordHandler) handleAlert(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	args := strings.Fields(data)
+	if len(args) < 1 {
+		return errors.New("Alert needs list, add or rm")
+	}
+	if args[0] == "list" {
+		return discord.handleAlertList(m)
+	}
+	// Rules are shared by every guild.
+	if err := discord.checkGlobalAdmin(m); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "add":
+		rule, err := ParseAlertRule(args[1:])
+		if err != nil {
+			return err
+		}
+		if server := discord.findServer(rule.Server); server != nil && rule.Server != AnyServer {
+			rule.Server = server.Id()
+		}
+		discord.updateAlerts(func(alerts *AlertConfig) error {
+			alerts.Rules = append(alerts.Rules, rule)
+			return nil
+		})
+	case "rm":
+		if len(args) != 2 {
+			return errors.New("Alert rm needs {number}")
+		}
+		n, err := strconv.Atoi(args[1])
+		// The rules may change until updateAlerts holds the lock, so the number is checked there.
+		err = discord.updateAlerts(func(alerts *AlertConfig) error {
+			if err != nil || n < 1 || n > len(alerts.Rules) {
+				return fmt.Errorf("%s is not an alert rule number", args[1])
+			}
+			alerts.Rules = append(alerts.Rules[:n-1], alerts.Rules[n:]...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown alert subcommand %s", args[0])
+	}
+	return discord.masterconfig.Write()
+}
+
+func (discord *DiscordHandler) handleAlertList(m *discordgo.MessageCreate) error {
+	config := discord.currentConfig()
+	guild := discord.guildConfig(m.GuildID)
+	lines := []string{"Alert rules:"}
+	for i, rule := range config.Alerts.Rules {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, discord.ruleText(rule)))
+	}
+	if len(config.Alerts.Rules) == 0 {
+		lines = append(lines, "None.")
+	}
+	for _, firing := range discord.alerts.Firing() {
+		if guild.Sees(firing.ServerId) {
+			lines = append(lines, Emoji_Warn+" Firing: "+discord.serverName(firing.ServerId)+": "+discord.ruleText(firing.Rule))
+		}
+	}
+	if guild.AlertChannel == "" {
+		lines = append(lines, "No alert channel is set for this guild, see guild.alertChannel.")
+	}
+	_, err := discord.session.ChannelMessageSend(m.ChannelID, strings.Join(lines, "\n"))
+	return err
+}
+
+// updateAlerts changes the alert rules through a copy, so readers holding the old slice are unaffected.
+// Nothing changes if update returns an error.
+func (discord *DiscordHandler) updateAlerts(update func(alerts *AlertConfig) error) error {
+	discord.configMutex.Lock()
+	defer discord.configMutex.Unlock()
+	alerts := discord.config.Alerts
+	alerts.Rules = append([]AlertRule(nil), alerts.Rules...)
+	if err := update(&alerts); err != nil {
+		return err
+	}
+	discord.config.Alerts = alerts
+	return nil
+}
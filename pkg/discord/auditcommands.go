@@ -0,0 +1,133 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	DefaultAuditCount = 10
+	MaxAuditCount     = 50
+)
+
+// audit records administrative commands, read-only ones like ls are left out.
+func (discord *DiscordHandler) audit(command string, data string, m *discordgo.MessageCreate, err error) {
+	if discord.auditlog == nil {
+		return
+	}
+	server := ""
+	switch command {
+	case "setchannel", "cmdrole":
+	case "as":
+		if args := strings.SplitN(data, " ", 2); len(args) > 1 {
+			server = args[1]
+		}
+	case "rm", "link", "unlink":
+		server = strings.TrimSpace(data)
+	case "move":
+		if split := strings.LastIndex(strings.TrimSpace(data), " "); split >= 0 {
+			server = strings.TrimSpace(data)[:split]
+		}
+	case "cmd", "tag", "broadcast", "rename":
+		server = strings.SplitN(strings.TrimSpace(data), " ", 2)[0]
+	case "alert":
+		if args := strings.Fields(data); len(args) == 0 || args[0] == "list" {
+			return
+		}
+	case "config":
+		if args := strings.Fields(data); len(args) == 0 || args[0] == "list" || args[0] == "get" {
+			return
+		}
+	default:
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	entry := api.AuditEntry{
+		UserId:  m.Author.ID,
+		User:    m.Author.String(),
+		GuildId: m.GuildID,
+		Command: command,
+		Args:    data,
+		Server:  server,
+		Result:  result,
+	}
+	if err := discord.auditlog.Append(entry); err != nil {
+		fmt.Println("Error writing audit log,", err)
+	}
+}
+
+// postModLog sends an entry to the mod-log channel of the guild it came from, or to
+// every mod-log channel if it did not come from a guild.
+func (discord *DiscordHandler) postModLog(entry api.AuditEntry) {
+	for id, guild := range discord.currentConfig().Guilds {
+		if guild.ModLogChannel == "" || (entry.GuildId != "" && entry.GuildId != id) {
+			continue
+		}
+		if _, err := discord.session.ChannelMessageSend(guild.ModLogChannel, formatAuditEntry(entry)); err != nil {
+			fmt.Println("Error posting to mod-log,", err)
+		}
+	}
+}
+
+func formatAuditEntry(entry api.AuditEntry) string {
+	text := fmt.Sprintf("%s %s: %s", entry.Time.Format("2006-01-02 15:04:05"), entry.User, entry.Command)
+	if entry.Args != "" {
+		text += " " + entry.Args
+	}
+	if entry.Server != "" {
+		text += " [" + entry.Server + "]"
+	}
+	return text + " -> " + entry.Result
+}
+
+// handleAudit shows the latest audit entries, this guild's and those from outside any guild.
+func (discord *DiscordHandler) handleAudit(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	if discord.auditlog == nil {
+		return errors.New("No audit log")
+	}
+	n := DefaultAuditCount
+	if data = strings.TrimSpace(data); data != "" {
+		var err error
+		n, err = strconv.Atoi(data)
+		if err != nil || n < 1 || n > MaxAuditCount {
+			return fmt.Errorf("Audit count must be between 1 and %d", MaxAuditCount)
+		}
+	}
+	// Read more than asked for, since other guilds' entries are filtered out.
+	entries, err := discord.auditlog.Recent(n * 10)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, entry := range entries {
+		if entry.GuildId == "" || entry.GuildId == m.GuildID {
+			lines = append(lines, formatAuditEntry(entry))
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No audit entries.")
+	}
+	for _, chunk := range SplitMessage(strings.Join(lines, "\n"), DiscordMessageLimit) {
+		if _, err = discord.session.ChannelMessageSend(m.ChannelID, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"fmt"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	// ChatSource and DiscordSource prefix the source of commands sent for relayed chat and
+	// for Discord commands.
+	ChatSource    = "chat:"
+	DiscordSource = "discord:"
+	// RoleColor as a name color uses the color of the sender's highest colored role.
+	RoleColor = "role"
+)
+
+// ChatFormatConfig controls how Discord chat looks in game.
+type ChatFormatConfig struct {
+	// Tellraw sends JSON text components, otherwise chat falls back to plain say.
+	Tellraw   bool   `json:"tellraw"`
+	Tag       string `json:"tag"`
+	TagColor  string `json:"tagColor"`
+	NameColor string `json:"nameColor"`
+	TextColor string `json:"textColor"`
+}
+
+func DefaultChatFormatConfig() ChatFormatConfig {
+	return ChatFormatConfig{
+		Tellraw:   true,
+		Tag:       "[Discord]",
+		TagColor:  "blue",
+		NameColor: RoleColor,
+		TextColor: "white",
+	}
+}
+
+func chatFormatOptions() []api.ConfigOption {
+	defaults := DefaultChatFormatConfig()
+	path := ConfigKey + ".chat."
+	return []api.ConfigOption{
+		api.BoolOption(path+"tellraw", "Send chat as tellraw text, false uses say.", defaults.Tellraw),
+		api.StringOption(path+"tag", "Text shown before Discord names in game.", defaults.Tag, nil),
+		api.StringOption(path+"tagColor", "Color of the tag.", defaults.TagColor, validateColor),
+		api.StringOption(path+"nameColor", "Color of Discord names, role uses the sender's role color.", defaults.NameColor, func(value string) error {
+			if value == RoleColor {
+				return nil
+			}
+			return validateColor(value)
+		}),
+		api.StringOption(path+"textColor", "Color of the message text.", defaults.TextColor, validateColor),
+	}
+}
+
+func validateColor(value string) error {
+	if !api.ValidMcColor(value) {
+		return fmt.Errorf("%s is not a Minecraft color name or #rrggbb", value)
+	}
+	return nil
+}
+
+// chatCommand builds the in-game command for one line of a Discord message.
+func (discord *DiscordHandler) chatCommand(o api.MessageWithSender, line string) (api.Command, error) {
+	format := discord.currentConfig().Chat
+	if !format.Tellraw {
+		return api.Command{Command: fmt.Sprintf("say %s: %s", api.SayText(o.Sender), api.SayText(line)), Source: chatSource(o)}, nil
+	}
+	line = api.SanitizeText(line)
+
+	name := api.TextComponent{Text: api.PlainText(o.Sender), Color: format.NameColor}
+	if format.NameColor == RoleColor {
+		name.Color = discord.roleColor(o.GuildId, o.SenderId)
+	}
+	if o.SenderTag != "" {
+		name.HoverEvent = api.ShowText(api.PlainText(o.SenderTag))
+	}
+
+	var components []api.TextComponent
+	if format.Tag != "" {
+		components = append(components, api.TextComponent{Text: api.PlainText(format.Tag) + " ", Color: format.TagColor})
+	}
+	components = append(components,
+		name,
+		api.TextComponent{Text: ": " + api.PlainText(line), Color: format.TextColor},
+	)
+	command, err := api.TellrawCommand("@a", components)
+	command.Source = chatSource(o)
+	return command, err
+}
+
+func chatSource(o api.MessageWithSender) string {
+	if o.SenderTag != "" {
+		return ChatSource + o.SenderTag
+	}
+	return ChatSource + o.Sender
+}
+
+// roleColor returns the color of a member's highest colored role, or no color if they have none.
+func (discord *DiscordHandler) roleColor(guildID string, userID string) string {
+	if guildID == "" || userID == "" {
+		return ""
+	}
+	member, err := discord.session.GuildMember(guildID, userID)
+	if err != nil {
+		return ""
+	}
+	roles, err := discord.session.GuildRoles(guildID)
+	if err != nil {
+		fmt.Println("Error looking up guild roles,", err)
+		return ""
+	}
+	color, position := 0, -1
+	for _, role := range roles {
+		if role.Color == 0 || role.Position <= position {
+			continue
+		}
+		for _, id := range member.Roles {
+			if id == role.ID {
+				color, position = role.Color, role.Position
+			}
+		}
+	}
+	if position < 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%06x", color)
+}
@@ -0,0 +1,227 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+// ConfigOptions lists every discord value that can be changed with !config set.
+func ConfigOptions() []api.ConfigOption {
+	options := append(configOptions(), rateLimitOptions()...)
+	options = append(options, chatFormatOptions()...)
+	return append(options, alertOptions()...)
+}
+
+// configOptions lists the general discord values that can be changed with !config set.
+func configOptions() []api.ConfigOption {
+	return []api.ConfigOption{
+		api.StringOption(ConfigKey+".controlChar", "Prefix for bot commands in guilds without their own.", "!", func(value string) error {
+			if value == "" || strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+				return errors.New("controlChar must be non-empty and contain no spaces")
+			}
+			return nil
+		}),
+		api.ListOption(ConfigKey+".deniedCommands", "Console commands never run from Discord besides the built in ones, comma separated.", nil),
+		api.ListOption(ConfigKey+".adminUsers", "User IDs that may change settings every guild shares, comma separated.", isSnowflake),
+	}
+}
+
+// ValidateConfig checks the discord section, it is also used by the command line when editing offline.
+func ValidateConfig(data json.RawMessage) error {
+	// Keys the file leaves out keep their defaults, as they do when the config is read.
+	config := DefaultDiscordHandlerConfig()
+	if err := unmarshalConfig(data, &config); err != nil {
+		return err
+	}
+	if config.ControlChar == "" {
+		return errors.New("controlChar must not be empty")
+	}
+	limits := config.RateLimit
+	if limits.UserBurst < 1 || limits.ServerBurst < 1 || limits.BatchMillis < 1 || limits.BatchMaxLines < 1 {
+		return errors.New("rateLimit bursts, batchMillis and batchMaxLines must be positive")
+	}
+	if limits.UserPerMinute < 0 || limits.ServerPerMinute < 0 {
+		return errors.New("rateLimit rates must not be negative")
+	}
+	if err := validateColor(config.Chat.TagColor); err != nil {
+		return err
+	}
+	if err := validateColor(config.Chat.TextColor); err != nil {
+		return err
+	}
+	if config.Chat.NameColor != RoleColor {
+		if err := validateColor(config.Chat.NameColor); err != nil {
+			return err
+		}
+	}
+	if config.Alerts.CooldownSeconds < 0 {
+		return errors.New("alerts cooldownSeconds must not be negative")
+	}
+	for _, rule := range config.Alerts.Rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for id, guild := range config.Guilds {
+		if err := isSnowflake(id); err != nil {
+			return fmt.Errorf("guild %v", err)
+		}
+		if strings.IndexFunc(guild.ControlChar, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("controlChar of guild %s must not contain spaces", id)
+		}
+	}
+	for _, user := range config.AdminUsers {
+		if err := isSnowflake(user); err != nil {
+			return fmt.Errorf("adminUsers: %v", err)
+		}
+	}
+	return nil
+}
+
+// handleConfig dispatches !config subcommands.
+func (discord *DiscordHandler) handleConfig(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	args := strings.Fields(data)
+	if len(args) < 1 {
+		return errors.New("Config needs a subcommand")
+	}
+	switch args[0] {
+	case "list":
+		return discord.handleConfigList(m)
+	case "get":
+		if len(args) < 2 {
+			return errors.New("Config get needs {path}")
+		}
+		return discord.handleConfigGet(args[1], m)
+	case "set":
+		if len(args) < 3 {
+			return errors.New("Config set needs {path} {value}")
+		}
+		check := discord.checkGlobalAdmin
+		if strings.HasPrefix(args[1], GuildPrefix) {
+			check = discord.checkAdmin
+		}
+		if err := check(m); err != nil {
+			return err
+		}
+		return discord.handleConfigSet(args[1], strings.Join(args[2:], " "), m)
+	case "restore":
+		if err := discord.checkGlobalAdmin(m); err != nil {
+			return err
+		}
+		return discord.handleConfigRestore(args[1:], m)
+	}
+	return fmt.Errorf("Unknown config subcommand: %s", args[0])
+}
+
+// handleConfigRestore rolls the config back to a backup, the most recent if no number is given.
+func (discord *DiscordHandler) handleConfigRestore(args []string, m *discordgo.MessageCreate) error {
+	n, err := api.ParseBackup(args)
+	if err != nil {
+		return err
+	}
+	if err = discord.masterconfig.Restore(n); err != nil {
+		fmt.Println("Error restoring config,", err)
+		return err
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Restored config backup %d.", n))
+	return err
+}
+
+// handleConfigList shows every settable option with its current value and default.
+func (discord *DiscordHandler) handleConfigList(m *discordgo.MessageCreate) error {
+	var fields []*discordgo.MessageEmbedField
+	options := discord.masterconfig.Options()
+	if m.GuildID != "" {
+		options = append(guildOptions(), options...)
+	}
+	for _, option := range options {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  option.Path,
+			Value: discord.describeOption(option, m.GuildID),
+		})
+	}
+	embed := &discordgo.MessageEmbed{
+		Author:      &discordgo.MessageEmbedAuthor{},
+		Color:       0x00ff00,
+		Description: "Options that can be changed with config set.",
+		Fields:      fields,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		Title:       "Config",
+	}
+	_, err := discord.session.ChannelMessageSendEmbed(m.ChannelID, embed)
+	return err
+}
+
+func (discord *DiscordHandler) handleConfigGet(path string, m *discordgo.MessageCreate) error {
+	option, err := discord.findOption(path, m.GuildID)
+	if err != nil {
+		return err
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, fmt.Sprintf("%s: %s", path, discord.describeOption(option, m.GuildID)))
+	return err
+}
+
+// findOption looks up a global option, or one of the guild's own when path starts with guild.
+func (discord *DiscordHandler) findOption(path string, guildID string) (api.ConfigOption, error) {
+	if strings.HasPrefix(path, GuildPrefix) {
+		if guildID == "" {
+			return api.ConfigOption{}, errors.New("Guild options can only be used in a guild")
+		}
+		for _, option := range guildOptions() {
+			if option.Path == path {
+				return option, nil
+			}
+		}
+	} else if option, ok := discord.masterconfig.Option(path); ok {
+		return option, nil
+	}
+	return api.ConfigOption{}, fmt.Errorf("Unknown config option %s", path)
+}
+
+// configPath maps a guild option onto its place in the config file.
+func configPath(path string, guildID string) string {
+	if strings.HasPrefix(path, GuildPrefix) {
+		return ConfigKey + ".guilds." + guildID + "." + strings.TrimPrefix(path, GuildPrefix)
+	}
+	return path
+}
+
+// handleConfigSet parses value with the option's type, then applies and writes it through the config.
+func (discord *DiscordHandler) handleConfigSet(path string, value string, m *discordgo.MessageCreate) error {
+	option, err := discord.findOption(path, m.GuildID)
+	if err != nil {
+		return err
+	}
+	data, err := option.Parse(value)
+	if err != nil {
+		return err
+	}
+	if err = discord.masterconfig.Set(configPath(path, m.GuildID), data); err != nil {
+		fmt.Println("Error setting config,", err)
+		return err
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Set %s to %s.", path, data))
+	return err
+}
+
+func (discord *DiscordHandler) describeOption(option api.ConfigOption, guildID string) string {
+	current := "unset"
+	if value, err := discord.masterconfig.Get(configPath(option.Path, guildID)); err == nil {
+		current = string(value)
+	}
+	def := option.Default
+	if def == "" {
+		def = "empty"
+	}
+	return fmt.Sprintf("%s\nCurrent: %s, default: %s", option.Description, current, def)
+}
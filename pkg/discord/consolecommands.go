@@ -0,0 +1,120 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+// commandPolicy collects the command patterns allowed to a member through their roles. The
+// default denied commands apply whatever the config lists.
+func (discord *DiscordHandler) commandPolicy(m *discordgo.MessageCreate) api.CommandPolicy {
+	denied := append(append([]string(nil), api.DefaultDeniedCommands...), discord.currentConfig().DeniedCommands...)
+	policy := api.CommandPolicy{Denied: denied}
+	guild := discord.guildConfig(m.GuildID)
+	if len(guild.CommandRoles) == 0 || m.GuildID == "" {
+		return policy
+	}
+	member, err := discord.session.GuildMember(m.GuildID, m.Author.ID)
+	if err != nil {
+		fmt.Println("Error looking up guild member,", err)
+		return policy
+	}
+	for _, role := range member.Roles {
+		policy.Allowed = append(policy.Allowed, guild.CommandRoles[role]...)
+	}
+	return policy
+}
+
+// auditCommand passes a console command sent or refused to the audit handler, if one is set.
+func (discord *DiscordHandler) auditCommand(entry api.CommandAudit) {
+	if discord.commandaudit == nil {
+		return
+	}
+	entry.Time = time.Now()
+	discord.commandaudit(entry)
+}
+
+// handleConsoleCommand runs a console command on one server, if the sender's roles allow it.
+func (discord *DiscordHandler) handleConsoleCommand(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	args := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	if len(args) < 2 {
+		return errors.New("Cmd needs {server} {command}")
+	}
+	var target api.IServer
+	for _, server := range discord.guildServers(m.GuildID) {
+		if server.Name() == args[0] {
+			target = server
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("Could not find a server of name %s", args[0])
+	}
+
+	source := DiscordSource + m.Author.String()
+	if err := discord.commandPolicy(m).Check(args[1]); err != nil {
+		discord.auditCommand(api.CommandAudit{Command: args[1], Source: source, Reason: err.Error()})
+		return err
+	}
+	command := api.Command{Command: args[1], Source: source}
+	var header api.Header
+	if err := api.MarshalCommandToHeader(&command, &header); err != nil {
+		return err
+	}
+	discord.auditCommand(api.CommandAudit{Command: args[1], Source: source, Allowed: true})
+	status, err := target.Send(header)
+	if err != nil {
+		return err
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Command %s for %s.", status, target.Name()))
+	return err
+}
+
+// handleCommandRole sets the command patterns a role may run, no patterns clears them.
+func (discord *DiscordHandler) handleCommandRole(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	if m.GuildID == "" {
+		return errors.New("Command roles can only be set in a guild")
+	}
+	// Without admin roles anyone could grant themselves console commands.
+	if len(discord.guildConfig(m.GuildID).AdminRoles) == 0 {
+		return errors.New("Command roles need adminRoles to be set for this guild")
+	}
+	args := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	if err := isSnowflake(args[0]); err != nil {
+		return err
+	}
+	var patterns []string
+	if len(args) > 1 {
+		for _, pattern := range strings.Split(args[1], ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	discord.updateGuild(m.GuildID, func(guild *GuildConfig) {
+		roles := make(map[string][]string, len(guild.CommandRoles)+1)
+		for role, allowed := range guild.CommandRoles {
+			roles[role] = allowed
+		}
+		if len(patterns) == 0 {
+			delete(roles, args[0])
+		} else {
+			roles[args[0]] = patterns
+		}
+		guild.CommandRoles = roles
+	})
+	return discord.masterconfig.Write()
+}
@@ -1,11 +1,14 @@
 package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/itszuvalex/mcdiscord/pkg/api"
@@ -14,6 +17,7 @@ import (
 const (
 	Emoji_Check string = "✅"
 	Emoji_X     string = "❌"
+	Emoji_Warn  string = "⚠️"
 	ConfigKey          = "discord"
 	BufferSize         = 100
 )
@@ -23,13 +27,24 @@ type commandHandler func(string, *discordgo.MessageCreate) error
 
 // DiscordHandler Struct that contains all Discord-related information and handles messages to/from Discord
 type DiscordHandler struct {
-	session         *discordgo.Session
+	session         ISession
 	commandHandlers map[string]commandHandler
 	config          DiscordHandlerConfig
+	configMutex     sync.RWMutex
 	Input, Output   chan api.MessageWithSender
-	stopchan        chan bool
 	masterconfig    api.IConfig
 	serverhandler   api.IServerHandler
+	auditlog        api.IAuditLog
+	commandaudit    api.CommandAuditHandler
+	chathistory     api.IChatHistory
+	sessions        api.IPlayerSessions
+	statushistory   api.IStatusHistory
+	removeHandlers  []func()
+	userLimiter     *rateLimiter
+	serverLimiter   *rateLimiter
+	alerts          *alerter
+	cancel          context.CancelFunc
+	wg              sync.WaitGroup
 }
 
 func (d *DiscordHandler) ChatInput() chan api.MessageWithSender {
@@ -44,33 +59,83 @@ func (d *DiscordHandler) SetServerHandler(handler api.IServerHandler) {
 	d.serverhandler = handler
 }
 
+func (d *DiscordHandler) SetChatHistory(history api.IChatHistory) {
+	d.chathistory = history
+}
+
+func (d *DiscordHandler) SetPlayerSessions(sessions api.IPlayerSessions) {
+	d.sessions = sessions
+}
+
+func (d *DiscordHandler) SetStatusHistory(history api.IStatusHistory) {
+	d.statushistory = history
+}
+
+func (d *DiscordHandler) SetAuditLog(log api.IAuditLog) {
+	d.auditlog = log
+	log.AddHandler(d.postModLog)
+}
+
+func (d *DiscordHandler) SetCommandAudit(handler api.CommandAuditHandler) {
+	d.commandaudit = handler
+}
+
+// DiscordHandlerConfig holds each guild's settings by guild ID. ChannelId is the single
+// relay channel of older configs, kept until a message shows which guild it belongs to.
 type DiscordHandlerConfig struct {
-	ChannelId   string `json:"channelId"`
-	ControlChar string `json:"controlChar"`
+	ChannelId   string                 `json:"channelId"`
+	ControlChar string                 `json:"controlChar"`
+	Guilds      map[string]GuildConfig `json:"guilds"`
+	RateLimit   RateLimitConfig        `json:"rateLimit"`
+	Chat        ChatFormatConfig       `json:"chat"`
+	Alerts      AlertConfig            `json:"alerts"`
+	// DeniedCommands can never be run from Discord, whatever a role allows. They add to
+	// api.DefaultDeniedCommands, which are denied regardless.
+	DeniedCommands []string `json:"deniedCommands"`
+	// AdminUsers may change what every guild shares: the discord and servers config, alert
+	// rules and servers other guilds also see.
+	AdminUsers []string `json:"adminUsers"`
 }
 
 // NewDiscordHandler Creates a new DiscordHandler given a bot Token
 func NewDiscordHandler(token string, masterconfig api.IConfig) (*DiscordHandler, error) {
-	session, err := discordgo.New("Bot " + token)
+	session, err := NewSession(token)
 	if err != nil {
 		fmt.Println("Error creating Discord session, ", err)
 		return nil, err
 	}
+	return NewDiscordHandlerWithSession(session, masterconfig)
+}
+
+// DefaultDiscordHandlerConfig returns the config used for keys the config file leaves out.
+func DefaultDiscordHandlerConfig() DiscordHandlerConfig {
+	return DiscordHandlerConfig{
+		ChannelId:      "",
+		ControlChar:    "!",
+		Guilds:         make(map[string]GuildConfig),
+		RateLimit:      DefaultRateLimitConfig(),
+		Chat:           DefaultChatFormatConfig(),
+		Alerts:         DefaultAlertConfig(),
+		DeniedCommands: append([]string(nil), api.DefaultDeniedCommands...),
+	}
+}
+
+// NewDiscordHandlerWithSession Creates a new DiscordHandler on top of an existing session
+func NewDiscordHandlerWithSession(session ISession, masterconfig api.IConfig) (*DiscordHandler, error) {
 	handler := &DiscordHandler{
 		session:         session,
 		commandHandlers: make(map[string]commandHandler),
-		config: DiscordHandlerConfig{
-			ChannelId:   "",
-			ControlChar: "!",
-		},
-		Input:        make(chan api.MessageWithSender, BufferSize),
-		Output:       make(chan api.MessageWithSender, BufferSize),
-		stopchan:     make(chan bool, 2),
-		masterconfig: masterconfig,
+		config:          DefaultDiscordHandlerConfig(),
+		Input:           make(chan api.MessageWithSender, BufferSize),
+		Output:          make(chan api.MessageWithSender, BufferSize),
+		masterconfig:    masterconfig,
+		userLimiter:     newRateLimiter(),
+		serverLimiter:   newRateLimiter(),
+		alerts:          newAlerter(),
 	}
 
 	// Add handlers
-	handler.AddHandler(handler.messageCreate)
+	handler.removeHandlers = append(handler.removeHandlers, handler.AddHandler(handler.messageCreate))
 	//handler.AddHandler(handler.messageReactionAdd)
 
 	// Add command handlers
@@ -80,9 +145,31 @@ func NewDiscordHandler(token string, masterconfig api.IConfig) (*DiscordHandler,
 	handler.AddCommandHandler("ls", handler.handleListServers)
 	handler.AddCommandHandler("as", handler.handleAddServer)
 	handler.AddCommandHandler("rm", handler.handleRemoveServer)
+	handler.AddCommandHandler("link", handler.handleLink)
+	handler.AddCommandHandler("unlink", handler.handleUnlink)
+	handler.AddCommandHandler("rename", handler.handleRename)
+	handler.AddCommandHandler("move", handler.handleMove)
+	handler.AddCommandHandler("tag", handler.handleTag)
+	handler.AddCommandHandler("status", handler.handleStatus)
+	handler.AddCommandHandler("broadcast", handler.handleBroadcast)
+	handler.AddCommandHandler("cmd", handler.handleConsoleCommand)
+	handler.AddCommandHandler("cmdrole", handler.handleCommandRole)
+	handler.AddCommandHandler("audit", handler.handleAudit)
+	handler.AddCommandHandler("history", handler.handleHistory)
+	handler.AddCommandHandler("search", handler.handleSearch)
+	handler.AddCommandHandler("playtime", handler.handlePlaytime)
+	handler.AddCommandHandler("top", handler.handleTop)
+	handler.AddCommandHandler("seen", handler.handleSeen)
+	handler.AddCommandHandler("alert", handler.handleAlert)
+	handler.AddCommandHandler("graph", handler.handleGraph)
+	handler.AddCommandHandler("config", handler.handleConfig)
 
 	handler.masterconfig.AddReadHandler(ConfigKey, handler.handleConfigRead)
 	handler.masterconfig.AddWriteHandler(ConfigKey, handler.handleConfigWrite)
+	handler.masterconfig.AddValidateHandler(ConfigKey, ValidateConfig)
+	for _, option := range ConfigOptions() {
+		handler.masterconfig.AddOption(option)
+	}
 
 	return handler, nil
 }
@@ -91,51 +178,191 @@ func (discord *DiscordHandler) AddHandler(handler interface{}) func() {
 	return discord.session.AddHandler(handler)
 }
 
-func (discord *DiscordHandler) Open() error {
+func (discord *DiscordHandler) Open(ctx context.Context) error {
 	err := discord.session.Open()
 	if err != nil {
 		return err
 	}
 
-	go discord.HandleInputChannel()
-	go discord.HandleOutputChannel()
+	ctx, discord.cancel = context.WithCancel(ctx)
+	discord.wg.Add(2)
+	go discord.HandleInputChannel(ctx)
+	go discord.HandleOutputChannel(ctx)
 
 	return nil
 }
 
-func (discord *DiscordHandler) HandleInputChannel() {
+// HandleInputChannel relays server chat to Discord, batching lines from each server into one
+// message and flushing anything still buffered once ctx is done.
+func (discord *DiscordHandler) HandleInputChannel(ctx context.Context) {
+	defer discord.wg.Done()
+	batch := newInputBatch()
+	timer := time.NewTimer(discord.batchInterval())
+	defer timer.Stop()
 	for {
 		select {
-		case <-discord.stopchan:
-			return
+		case <-ctx.Done():
+			for {
+				select {
+				case i := <-discord.Input:
+					discord.recordGame(i)
+					batch.Add(i, 0)
+				default:
+					discord.flushInput(batch, true)
+					return
+				}
+			}
 		case i := <-discord.Input:
-			if discord.config.ChannelId != "" {
-				discord.session.ChannelMessageSend(discord.config.ChannelId, i.Sender+": "+i.Message)
+			discord.recordGame(i)
+			batch.Add(i, discord.currentConfig().RateLimit.BatchMaxLines)
+		case <-timer.C:
+			discord.flushInput(batch, false)
+			timer.Reset(discord.batchInterval())
+		}
+	}
+}
+
+func (discord *DiscordHandler) batchInterval() time.Duration {
+	return time.Duration(discord.currentConfig().RateLimit.BatchMillis) * time.Millisecond
+}
+
+// flushInput posts each server's batched lines, holding them back while the server is
+// throttled unless force is set.
+func (discord *DiscordHandler) flushInput(batch *inputBatch, force bool) {
+	limits := discord.currentConfig().RateLimit
+	for server, lines := range batch.lines {
+		allowed, started := discord.serverLimiter.Allow(server, limits.ServerBurst, limits.ServerPerMinute)
+		if started {
+			discord.sendInput(server, fmt.Sprintf("Server %s is sending chat too fast, batching its messages.", server))
+		}
+		if !allowed && !force {
+			continue
+		}
+		var text []string
+		if dropped := batch.dropped[server]; dropped > 0 {
+			text = append(text, fmt.Sprintf("(%d lines dropped)", dropped))
+		}
+		for _, i := range lines {
+			text = append(text, i.Sender+": "+i.Message)
+		}
+		discord.sendInput(server, strings.Join(text, "\n"))
+		delete(batch.lines, server)
+		delete(batch.dropped, server)
+	}
+}
+
+func (discord *DiscordHandler) sendInput(server string, text string) {
+	for _, channel := range discord.relayChannels(server) {
+		for _, chunk := range SplitMessage(text, DiscordMessageLimit) {
+			if _, err := discord.session.ChannelMessageSend(channel, chunk); err != nil {
+				fmt.Println("Error relaying chat to Discord,", err)
 			}
 		}
 	}
 }
 
-func (discord *DiscordHandler) HandleOutputChannel() {
+// HandleOutputChannel relays Discord chat to the servers, flushing anything still buffered once ctx is done.
+func (discord *DiscordHandler) HandleOutputChannel(ctx context.Context) {
+	defer discord.wg.Done()
 	for {
 		select {
-		case <-discord.stopchan:
-			return
-		case o := <-discord.Output:
-			command := api.Command{fmt.Sprintf("say %s: %s", o.Sender, o.Message)}
-			var header api.Header
-			err := api.MarshalCommandToHeader(&command, &header)
-			if err != nil {
-				fmt.Println("Error marshalling command", err)
+		case <-ctx.Done():
+			for {
+				select {
+				case o := <-discord.Output:
+					discord.sendOutput(o)
+				default:
+					return
+				}
 			}
-			discord.serverhandler.SendPacketToAllServers(header)
+		case o := <-discord.Output:
+			discord.sendOutput(o)
 		}
 	}
 }
 
-func (discord *DiscordHandler) Close() error {
-	discord.stopchan <- true
-	discord.stopchan <- true
+// sendOutput sends a Discord message to the servers one line at a time, since chat cannot
+// show newlines and long lines wrap badly. Lines are only queued here, delivery is waited
+// for in the background so a slow server never holds up the relay.
+func (discord *DiscordHandler) sendOutput(o api.MessageWithSender) {
+	prefix := discord.currentConfig().Chat.Tag + " " + o.Sender + ": "
+	var queued api.DeliverySummary
+	var pending []api.PendingSummary
+	for _, line := range SplitLines(o.Message, MinecraftChatLimit-utf8.RuneCountInString(prefix)) {
+		command, err := discord.chatCommand(o, line)
+		if err != nil {
+			fmt.Println("Error building chat command", err)
+			continue
+		}
+		var header api.Header
+		err = api.MarshalCommandToHeader(&command, &header)
+		if err != nil {
+			fmt.Println("Error marshalling command", err)
+			continue
+		}
+		discord.auditCommand(api.CommandAudit{Command: command.Command, Source: command.Source, Allowed: true})
+		var results api.DeliverySummary
+		var wait api.PendingSummary
+		if guild := discord.guildConfig(o.GuildId); len(guild.Servers) > 0 {
+			results, wait = discord.serverhandler.QueuePacketToServers(header, guild.Servers)
+		} else {
+			results, wait = discord.serverhandler.QueuePacketToAllServers(header)
+		}
+		queued.Results = append(queued.Results, results.Results...)
+		pending = append(pending, wait)
+	}
+	discord.recordDiscord(o, queued)
+
+	discord.wg.Add(1)
+	go func() {
+		defer discord.wg.Done()
+		var summary api.DeliverySummary
+		for _, wait := range pending {
+			summary.Results = append(summary.Results, wait().Results...)
+		}
+		discord.reportDelivery(o, summary)
+	}()
+}
+
+// reportDelivery flags a relayed message with a warning reaction if any server missed it.
+func (discord *DiscordHandler) reportDelivery(o api.MessageWithSender, summary api.DeliverySummary) {
+	if !summary.Missed() {
+		return
+	}
+	for _, result := range summary.Results {
+		if result.Status != api.Delivered {
+			fmt.Println("Message from", o.Sender, "was", result.Status, "for server", result.Name)
+		}
+	}
+	if o.ChannelId == "" || o.MessageId == "" {
+		return
+	}
+	err := discord.session.MessageReactionAdd(o.ChannelId, o.MessageId, Emoji_Warn)
+	if err != nil {
+		fmt.Println("Error adding reaction, ", err)
+	}
+}
+
+// Close stops accepting Discord messages, flushes pending chat in both directions,
+// posts an offline notice and closes the session.
+func (discord *DiscordHandler) Close(ctx context.Context) error {
+	for _, remove := range discord.removeHandlers {
+		remove()
+	}
+	discord.removeHandlers = nil
+
+	if discord.cancel != nil {
+		discord.cancel()
+		if err := api.WaitContext(ctx, &discord.wg); err != nil {
+			fmt.Println("Timed out flushing Discord chat,", err)
+		}
+	}
+
+	for _, channel := range discord.allChannels() {
+		if _, err := discord.session.ChannelMessageSend(channel, api.OfflineNotice); err != nil {
+			fmt.Println("Error sending offline notice,", err)
+		}
+	}
 	return discord.session.Close()
 }
 
@@ -149,7 +376,7 @@ func (discord *DiscordHandler) AddCommandHandler(command string, handler command
 }
 
 func (discord *DiscordHandler) messageReactionAdd(s *discordgo.Session, m *discordgo.MessageReactionAdd) {
-	if m.UserID == s.State.User.ID {
+	if m.UserID == discord.session.UserID() {
 		return
 	}
 
@@ -157,28 +384,71 @@ func (discord *DiscordHandler) messageReactionAdd(s *discordgo.Session, m *disco
 }
 
 func (discord *DiscordHandler) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if m.Author.ID == s.State.User.ID {
+	if m.Author.ID == discord.session.UserID() {
 		return
 	}
 
 	go func() {
 		println("Received message: ", m.Content, ", from user: ", m.Author.Username)
+		discord.adoptLegacyChannel(m)
 		if discord.isCommandMessage(m) {
-			err := discord.handleCommandMessage(s, m)
+			err := discord.handleCommandMessage(m)
 			if err != nil {
 
 			}
 		} else {
-			if m.Message.ChannelID == discord.config.ChannelId {
+			if m.Message.ChannelID == discord.guildConfig(m.GuildID).ChannelId {
+				if !discord.allowUser(m) {
+					return
+				}
 				println("Broadcasting message from user: ", m.Author.Username, ", with message: ", m.Content)
-				discord.Output <- api.MessageWithSender{Message: m.Content, Sender: m.Author.Username}
+				discord.Output <- api.MessageWithSender{Message: withAttachments(m.Message, MinecraftChatLimit-utf8.RuneCountInString(m.Author.Username)-2), Sender: m.Author.Username, SenderId: m.Author.ID, SenderTag: m.Author.String(), GuildId: m.GuildID, ChannelId: m.ChannelID, MessageId: m.ID}
 			}
 		}
 	}()
 }
 
+// allowUser applies the per-user limit to chat relayed to the servers, telling the
+// channel once when a user starts being throttled.
+func (discord *DiscordHandler) allowUser(m *discordgo.MessageCreate) bool {
+	limits := discord.currentConfig().RateLimit
+	allowed, started := discord.userLimiter.Allow(m.GuildID+"/"+m.Author.ID, limits.UserBurst, limits.UserPerMinute)
+	if started {
+		notice := fmt.Sprintf("%s is sending messages too fast, some will not reach the servers.", m.Author.Username)
+		if _, err := discord.session.ChannelMessageSend(m.ChannelID, notice); err != nil {
+			fmt.Println("Error sending throttle notice,", err)
+		}
+	}
+	return allowed
+}
+
+// withAttachments appends a line per attachment, so players see the link, or just the
+// file name when the link does not fit on a line of width.
+func withAttachments(m *discordgo.Message, width int) string {
+	lines := []string{m.Content}
+	for _, attachment := range m.Attachments {
+		line := fmt.Sprintf("[%s] %s", attachment.Filename, attachment.URL)
+		if utf8.RuneCountInString(line) > width {
+			line = fmt.Sprintf("[%s]", attachment.Filename)
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
 func (discord *DiscordHandler) handleSetChannel(data string, m *discordgo.MessageCreate) error {
-	discord.config.ChannelId = m.ChannelID
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	if m.GuildID == "" {
+		discord.configMutex.Lock()
+		discord.config.ChannelId = m.ChannelID
+		discord.configMutex.Unlock()
+	} else {
+		discord.updateGuild(m.GuildID, func(guild *GuildConfig) {
+			guild.ChannelId = m.ChannelID
+		})
+	}
 	return discord.masterconfig.Write()
 }
 
@@ -187,14 +457,14 @@ func (discord *DiscordHandler) handleJsonTest(data string, m *discordgo.MessageC
 }
 
 func (discord *DiscordHandler) handleListServers(data string, m *discordgo.MessageCreate) error {
-	if discord.config.ChannelId != m.Message.ChannelID {
-		return errors.New("Wrong channel")
+	if err := discord.checkChannel(m); err != nil {
+		return err
 	}
 	var serverfields []*discordgo.MessageEmbedField
-	for _, server := range discord.serverhandler.Servers() {
+	for _, server := range discord.guildServers(m.GuildID) {
 		serverfields = append(serverfields, &discordgo.MessageEmbedField{
-			Name:  fmt.Sprintf("%s", server.Name()),
-			Value: fmt.Sprintf("%s:%d", server.Location().Address, server.Location().Port),
+			Name:  serverTitle(server),
+			Value: server.Location().String(),
 		})
 	}
 	embed := &discordgo.MessageEmbed{
@@ -205,7 +475,7 @@ func (discord *DiscordHandler) handleListServers(data string, m *discordgo.Messa
 		Timestamp:   time.Now().Format(time.RFC3339),
 		Title:       "List Servers",
 	}
-	_, err := discord.session.ChannelMessageSendEmbed(discord.config.ChannelId, embed)
+	_, err := discord.session.ChannelMessageSendEmbed(m.ChannelID, embed)
 	if err != nil {
 		return err
 	}
@@ -213,16 +483,19 @@ func (discord *DiscordHandler) handleListServers(data string, m *discordgo.Messa
 }
 
 func (discord *DiscordHandler) handleAddServer(data string, m *discordgo.MessageCreate) error {
-	if discord.config.ChannelId != m.Message.ChannelID {
-		return errors.New("Wrong channel")
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
 	}
 	args := strings.Split(data, " ")
 	if len(args) < 2 {
 		fmt.Println("Add server needs server name.")
-		return errors.New("Add server needs args {ip:port} {name}")
+		return errors.New("Add server needs args {host[:port]} {name}")
 	}
 
-	location, err := api.ParseNetLocation(args[0])
+	location, err := discord.serverhandler.ResolveLocation(args[0])
 	if err != nil {
 		fmt.Println("Add server could not parse NetLocation:", err)
 		return err
@@ -234,53 +507,128 @@ func (discord *DiscordHandler) handleAddServer(data string, m *discordgo.Message
 		fmt.Println("Add server could not add server", err)
 		return err
 	}
+	if len(discord.guildConfig(m.GuildID).Servers) > 0 {
+		discord.updateGuild(m.GuildID, func(guild *GuildConfig) {
+			guild.Servers = append(append([]string(nil), guild.Servers...), name)
+		})
+		return discord.masterconfig.Write()
+	}
 	return nil
 }
+
+// handleRemoveServer removes a server shared by every guild, so a guild may only remove
+// servers it can see, and only unlinks one another guild still sees. Deleting a server
+// outright needs the guild to have admin roles set.
 func (discord *DiscordHandler) handleRemoveServer(data string, m *discordgo.MessageCreate) error {
-	if discord.config.ChannelId != m.Message.ChannelID {
-		return errors.New("Wrong channel")
+	if err := discord.checkChannel(m); err != nil {
+		return err
 	}
-	if strings.Contains(data, ":") {
-		location, err := api.ParseNetLocation(data)
-		if err != nil {
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	var target api.IServer
+	for loc, server := range discord.guildServers(m.GuildID) {
+		if server.Name() == data || loc.String() == data {
+			target = server
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("Could not find a server of name %s", data)
+	}
+	// Servers are shared, one guild only drops a server other guilds still see from its own view.
+	if discord.sharedWithOtherGuilds(target.Name(), m.GuildID) {
+		if err := discord.handleUnlink(target.Name(), m); err != nil {
 			return err
 		}
-		return discord.serverhandler.RemoveServer(*location)
-	} else {
-		return discord.serverhandler.RemoveServerByName(data)
+		_, err := discord.session.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Other guilds still see %s, unlinked it from this guild.", target.Name()))
+		return err
+	}
+	if discord.hasOtherGuilds(m.GuildID) && len(discord.guildConfig(m.GuildID).AdminRoles) == 0 {
+		return errors.New("Removing a server needs adminRoles to be set for this guild")
 	}
+	if err := discord.serverhandler.RemoveServer(target.Location()); err != nil {
+		return err
+	}
+	discord.forgetServer(target)
+	return discord.masterconfig.Write()
 }
 
 func (discord *DiscordHandler) handleConfigRead(data json.RawMessage) error {
-	err := json.Unmarshal(data, &discord.config)
+	config := discord.currentConfig()
+	config.Guilds = nil
+	// Decoding reuses a slice's array, which the live config still shares.
+	config.DeniedCommands = append([]string(nil), config.DeniedCommands...)
+	config.AdminUsers = append([]string(nil), config.AdminUsers...)
+	err := unmarshalConfig(data, &config)
 	if err != nil {
 		return err
 	}
+
+	discord.configMutex.Lock()
+	if config.ChannelId != discord.config.ChannelId {
+		fmt.Println("Relay channel changed to", config.ChannelId)
+	}
+	for id, guild := range config.Guilds {
+		if guild.ChannelId != discord.config.Guilds[id].ChannelId {
+			fmt.Println("Relay channel for guild", id, "changed to", guild.ChannelId)
+		}
+	}
+	if config.Guilds == nil {
+		config.Guilds = make(map[string]GuildConfig)
+	}
+	discord.config = config
+	discord.configMutex.Unlock()
 	return nil
 }
 
+// unmarshalConfig decodes data over config. Alert rules in data replace the current ones
+// outright, decoding into them would keep the fields a rule leaves out.
+func unmarshalConfig(data json.RawMessage, config *DiscordHandlerConfig) error {
+	var fields struct {
+		Alerts struct {
+			Rules json.RawMessage `json:"rules"`
+		} `json:"alerts"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if fields.Alerts.Rules != nil {
+		config.Alerts.Rules = nil
+	}
+	return json.Unmarshal(data, config)
+}
+
 func (discord *DiscordHandler) handleConfigWrite() (json.RawMessage, error) {
-	return json.Marshal(&discord.config)
+	config := discord.currentConfig()
+	return json.Marshal(&config)
+}
+
+// currentConfig returns a copy of the config, which may be replaced at any time by a reload.
+func (discord *DiscordHandler) currentConfig() DiscordHandlerConfig {
+	discord.configMutex.RLock()
+	defer discord.configMutex.RUnlock()
+	return discord.config
 }
 
 func (discord *DiscordHandler) isCommandMessage(m *discordgo.MessageCreate) bool {
-	return strings.HasPrefix(m.Content, discord.config.ControlChar)
+	return strings.HasPrefix(m.Content, discord.guildConfig(m.GuildID).ControlChar)
 }
 
 func (discord *DiscordHandler) parseCommandMessage(m *discordgo.MessageCreate) (string, string) {
 	var command, data string
-	ispace := strings.Index(m.Content, " ")
+	content := strings.TrimPrefix(m.Content, discord.guildConfig(m.GuildID).ControlChar)
+	ispace := strings.Index(content, " ")
 	if ispace > 0 {
-		command = m.Content[1:ispace]
-		data = m.Content[ispace+1:]
+		command = content[:ispace]
+		data = content[ispace+1:]
 	} else {
-		command = m.Content[1:]
+		command = content
 		data = ""
 	}
 	return command, data
 }
 
-func (discord *DiscordHandler) handleCommandMessage(s *discordgo.Session, m *discordgo.MessageCreate) error {
+func (discord *DiscordHandler) handleCommandMessage(m *discordgo.MessageCreate) error {
 	command, data := discord.parseCommandMessage(m)
 
 	println("Received command: ", command, ", from user: ", m.Author.Username, ", with data: ", data)
@@ -292,14 +640,15 @@ func (discord *DiscordHandler) handleCommandMessage(s *discordgo.Session, m *dis
 	}
 
 	err := handler(data, m)
+	discord.audit(command, data, m, err)
 	if err != nil {
-		err := s.MessageReactionAdd(m.Message.ChannelID, m.Message.ID, Emoji_X)
+		err := discord.session.MessageReactionAdd(m.Message.ChannelID, m.Message.ID, Emoji_X)
 		if err != nil {
 			fmt.Println("Error adding reaction, ", err)
 			return err
 		}
 	} else {
-		err := s.MessageReactionAdd(m.Message.ChannelID, m.Message.ID, Emoji_Check)
+		err := discord.session.MessageReactionAdd(m.Message.ChannelID, m.Message.ID, Emoji_Check)
 		if err != nil {
 			fmt.Println("Error adding reaction, ", err)
 			return err
@@ -0,0 +1,296 @@
+package discord_test // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/discord"
+	"github.com/itszuvalex/mcdiscord/pkg/discord/discordtest"
+	"github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+	"github.com/itszuvalex/mcdiscord/pkg/mctest"
+	"github.com/itszuvalex/mcdiscord/pkg/server"
+)
+
+const (
+	waitTimeout = 5 * time.Second
+	// Guild one limits its commands to admins, guild two has no admin roles.
+	guildOne   = "100"
+	channelOne = "101"
+	guildTwo   = "200"
+	channelTwo = "201"
+	adminRole  = "900"
+	testConfig = `{"discord": {"guilds": {
+		"100": {"channelId": "101", "adminRoles": ["900"]},
+		"200": {"channelId": "201"}
+	}}}`
+)
+
+type harness struct {
+	session *discordtest.Session
+	handler *discord.DiscordHandler
+	servers api.IServerHandler
+	cancel  context.CancelFunc
+	dir     string
+}
+
+// newHarness wires a Discord handler on a fake session to a real server handler, the way
+// mcdiscord does, with config read from configJSON.
+func newHarness(t *testing.T, configJSON string) *harness {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "discordtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(file, []byte(configJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := mcdiscord.NewConfig(file)
+	session := discordtest.NewSession()
+	handler, err := discord.NewDiscordHandlerWithSession(session, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := server.NewServerHandler(config, handler)
+	handler.SetServerHandler(servers)
+	if err = config.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = handler.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = servers.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return &harness{session: session, handler: handler, servers: servers, cancel: cancel, dir: dir}
+}
+
+func (h *harness) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	h.handler.Close(ctx)
+	h.servers.Close(ctx)
+	h.cancel()
+	os.RemoveAll(h.dir)
+}
+
+// command sends content as userID in a guild channel and returns the reaction it got.
+func (h *harness) command(t *testing.T, guildID, channelID, userID, content string) string {
+	t.Helper()
+	m := h.session.NewGuildMessage(guildID, channelID, userID, "user"+userID, content)
+	h.session.Inject(m)
+	var reaction string
+	if !h.session.WaitFor(func(s *discordtest.Session) bool {
+		reactions := s.ReactionsOn(m.ID)
+		if len(reactions) > 0 {
+			reaction = reactions[0]
+		}
+		return reaction != ""
+	}, waitTimeout) {
+		t.Fatalf("No reaction to %q", content)
+	}
+	return reaction
+}
+
+func (h *harness) serverNames() []string {
+	var names []string
+	for _, server := range h.servers.Servers() {
+		names = append(names, server.Name())
+	}
+	return names
+}
+
+func TestAddServer(t *testing.T) {
+	h := newHarness(t, testConfig)
+	defer h.Close()
+	h.session.SetMember(guildOne, "admin", adminRole)
+	h.session.SetMember(guildOne, "member")
+
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!as 127.0.0.1:25575 survival"); reaction != discord.Emoji_Check {
+		t.Fatalf("admin add reacted %s", reaction)
+	}
+	if names := h.serverNames(); len(names) != 1 || names[0] != "survival" {
+		t.Fatalf("servers after add %v", names)
+	}
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!as 127.0.0.1:25575 creative"); reaction != discord.Emoji_X {
+		t.Errorf("adding a second server at the same address reacted %s", reaction)
+	}
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!as notaport:x creative"); reaction != discord.Emoji_X {
+		t.Errorf("adding a server at a bad address reacted %s", reaction)
+	}
+	if len(h.serverNames()) != 1 {
+		t.Errorf("servers after failed adds %v", h.serverNames())
+	}
+}
+
+func TestRemoveServer(t *testing.T) {
+	h := newHarness(t, `{"discord": {"guilds": {
+		"100": {"channelId": "101", "adminRoles": ["900"]},
+		"200": {"channelId": "201", "servers": ["creative"]}
+	}}}`)
+	defer h.Close()
+	h.session.SetMember(guildOne, "admin", adminRole)
+	for port, name := range map[int]string{25575: "survival", 25576: "creative", 25577: "lobby"} {
+		if err := h.servers.AddServer(api.NetLocation{Address: "127.0.0.1", Port: port}, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!rm missing"); reaction != discord.Emoji_X {
+		t.Errorf("removing an unknown server reacted %s", reaction)
+	}
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!rm survival"); reaction != discord.Emoji_Check {
+		t.Fatalf("removing a server reacted %s", reaction)
+	}
+	if names := h.serverNames(); len(names) != 2 {
+		t.Errorf("servers after remove %v", names)
+	}
+
+	// Guild two still sees creative, so guild one only drops it from its own view.
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!rm creative"); reaction != discord.Emoji_Check {
+		t.Fatalf("removing a shared server reacted %s", reaction)
+	}
+	if names := h.serverNames(); len(names) != 2 {
+		t.Errorf("servers after removing a shared server %v", names)
+	}
+	if reaction := h.command(t, guildOne, channelOne, "admin", "!rm creative"); reaction != discord.Emoji_X {
+		t.Errorf("removing an unlinked server reacted %s", reaction)
+	}
+
+	// Without admin roles a guild cannot delete a server outright.
+	if reaction := h.command(t, guildTwo, channelTwo, "member", "!rm creative"); reaction != discord.Emoji_X {
+		t.Errorf("removing a server without admin roles reacted %s", reaction)
+	}
+	if names := h.serverNames(); len(names) != 2 {
+		t.Errorf("servers after a refused remove %v", names)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	h := newHarness(t, testConfig)
+	defer h.Close()
+	h.session.SetMember(guildOne, "admin", adminRole)
+	h.session.SetMember(guildOne, "member")
+
+	if reaction := h.command(t, guildOne, channelOne, "member", "!as 127.0.0.1:25575 survival"); reaction != discord.Emoji_X {
+		t.Errorf("member without an admin role add reacted %s", reaction)
+	}
+	if reaction := h.command(t, guildOne, channelTwo, "admin", "!as 127.0.0.1:25575 survival"); reaction != discord.Emoji_X {
+		t.Errorf("add from another guild's channel reacted %s", reaction)
+	}
+	if reaction := h.command(t, guildOne, "999", "admin", "!as 127.0.0.1:25575 survival"); reaction != discord.Emoji_X {
+		t.Errorf("add outside the relay channel reacted %s", reaction)
+	}
+	if names := h.serverNames(); len(names) != 0 {
+		t.Fatalf("servers after refused adds %v", names)
+	}
+	if reaction := h.command(t, guildOne, channelOne, "member", "!ls"); reaction != discord.Emoji_Check {
+		t.Errorf("member list reacted %s", reaction)
+	}
+}
+
+func TestSharedSettings(t *testing.T) {
+	h := newHarness(t, testConfig)
+	defer h.Close()
+	h.session.SetMember(guildOne, "300", adminRole)
+	if err := h.servers.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25575}, "survival"); err != nil {
+		t.Fatal(err)
+	}
+
+	// With two guilds and no adminUsers, settings every guild shares are locked.
+	if reaction := h.command(t, guildOne, channelOne, "300", "!config set guild.controlChar ?"); reaction != discord.Emoji_Check {
+		t.Errorf("guild admin setting a guild option reacted %s", reaction)
+	}
+	for _, content := range []string{"?config set discord.controlChar #", "?config restore", "?alert add * tps < 15", "?rename survival lobby"} {
+		if reaction := h.command(t, guildOne, channelOne, "300", content); reaction != discord.Emoji_X {
+			t.Errorf("guild admin %q reacted %s", content, reaction)
+		}
+	}
+	if reaction := h.command(t, guildTwo, channelTwo, "400", "!cmdrole 900 say"); reaction != discord.Emoji_X {
+		t.Errorf("command role in a guild without admin roles reacted %s", reaction)
+	}
+
+}
+
+func TestAdminUsers(t *testing.T) {
+	h := newHarness(t, `{"discord": {"adminUsers": ["300"], "guilds": {
+		"100": {"channelId": "101", "adminRoles": ["900"]},
+		"200": {"channelId": "201"}
+	}}}`)
+	defer h.Close()
+	if err := h.servers.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25575}, "survival"); err != nil {
+		t.Fatal(err)
+	}
+
+	if reaction := h.command(t, guildTwo, channelTwo, "400", "!alert add * tps < 15"); reaction != discord.Emoji_X {
+		t.Errorf("member adding an alert rule reacted %s", reaction)
+	}
+	if reaction := h.command(t, guildTwo, channelTwo, "300", "!alert add * tps < 15"); reaction != discord.Emoji_Check {
+		t.Errorf("global admin adding an alert rule reacted %s", reaction)
+	}
+	if reaction := h.command(t, guildTwo, channelTwo, "300", "!rename survival lobby"); reaction != discord.Emoji_Check {
+		t.Errorf("global admin rename reacted %s", reaction)
+	}
+}
+
+func TestRelayToServers(t *testing.T) {
+	h := newHarness(t, `{"discord": {"chat": {"tellraw": false}, "guilds": {"100": {"channelId": "101"}}}}`)
+	defer h.Close()
+	fake, err := mctest.NewServer(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.StatusInterval = 0
+	fake.Start()
+	defer fake.Close()
+	if err = h.servers.AddServer(fake.Location(), "survival"); err != nil {
+		t.Fatal(err)
+	}
+	if !h.session.WaitFor(func(*discordtest.Session) bool { return fake.Connections() == 1 }, waitTimeout) {
+		t.Fatal("Timed out waiting for the server to connect")
+	}
+
+	h.session.Inject(h.session.NewGuildMessage(guildOne, channelOne, "1", "alice", "hello\tworld\nsecond @a line"))
+	if !h.session.WaitFor(func(*discordtest.Session) bool { return len(fake.Commands()) == 2 }, waitTimeout) {
+		t.Fatalf("Relayed commands %v", fake.Commands())
+	}
+	commands := fake.Commands()
+	// Control characters become spaces, selectors are broken up and every line is sent on its own.
+	if commands[0] != "say alice: hello world" || commands[1] != "say alice: second @\u200ba line" {
+		t.Errorf("Relayed commands %q", commands)
+	}
+}
+
+func TestRelayToDiscord(t *testing.T) {
+	h := newHarness(t, `{"discord": {"guilds": {
+		"100": {"channelId": "101", "servers": ["survival"]},
+		"200": {"channelId": "201", "servers": ["creative"]}
+	}}}`)
+	defer h.Close()
+
+	h.handler.ChatInput() <- api.MessageWithSender{Server: "survival", Message: "<alice> first"}
+	h.handler.ChatInput() <- api.MessageWithSender{Server: "survival", Message: "<bob> second"}
+	if !h.session.WaitFor(func(s *discordtest.Session) bool { return len(s.Messages()) > 0 }, waitTimeout) {
+		t.Fatal("Timed out waiting for relayed chat")
+	}
+	messages := h.session.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Relayed %d messages, want one batch: %+v", len(messages), messages)
+	}
+	// Chat goes only to guilds that see the server, batched into one message.
+	if messages[0].ChannelID != channelOne {
+		t.Errorf("Relayed to channel %s", messages[0].ChannelID)
+	}
+	lines := strings.Split(messages[0].Content, "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "<alice> first") || !strings.HasSuffix(lines[1], "<bob> second") {
+		t.Errorf("Relayed %q", messages[0].Content)
+	}
+}
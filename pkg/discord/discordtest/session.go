@@ -0,0 +1,268 @@
+package discordtest // "github.com/itszuvalex/mcdiscord/pkg/discord/discordtest"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/discord"
+)
+
+const (
+	BotUserID    = "bot"
+	pollInterval = 10 * time.Millisecond
+)
+
+var _ discord.ISession = (*Session)(nil)
+
+type SentMessage struct {
+	ChannelID string
+	Content   string
+}
+
+type SentEmbed struct {
+	ChannelID string
+	Embed     *discordgo.MessageEmbed
+}
+
+type SentFile struct {
+	ChannelID string
+	Name      string
+	Data      []byte
+}
+
+type Reaction struct {
+	ChannelID string
+	MessageID string
+	Emoji     string
+}
+
+// Session is an in-memory stand-in for a Discord session. It records everything
+// the bot sends and lets tests inject MessageCreate events.
+type Session struct {
+	opened    bool
+	closed    bool
+	messages  []SentMessage
+	embeds    []SentEmbed
+	files     []SentFile
+	reactions []Reaction
+	members   map[string]*discordgo.Member
+	roles     map[string][]*discordgo.Role
+	handlers  map[int]func(*discordgo.Session, *discordgo.MessageCreate)
+	nextID    int
+	mutex     sync.Mutex
+}
+
+func NewSession() *Session {
+	return &Session{
+		members:  make(map[string]*discordgo.Member),
+		roles:    make(map[string][]*discordgo.Role),
+		handlers: make(map[int]func(*discordgo.Session, *discordgo.MessageCreate)),
+	}
+}
+
+func (session *Session) Open() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.opened = true
+	return nil
+}
+
+func (session *Session) Close() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.closed = true
+	return nil
+}
+
+func (session *Session) IsOpen() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.opened && !session.closed
+}
+
+func (session *Session) UserID() string {
+	return BotUserID
+}
+
+// AddHandler only understands MessageCreate handlers, anything else is ignored.
+func (session *Session) AddHandler(handler interface{}) func() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	create, ok := handler.(func(*discordgo.Session, *discordgo.MessageCreate))
+	if !ok {
+		return func() {}
+	}
+	id := session.newID()
+	session.handlers[id] = create
+	return func() {
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+		delete(session.handlers, id)
+	}
+}
+
+func (session *Session) ChannelMessageSend(channelID string, content string) (*discordgo.Message, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.messages = append(session.messages, SentMessage{ChannelID: channelID, Content: content})
+	return &discordgo.Message{ID: fmt.Sprint(session.newID()), ChannelID: channelID, Content: content}, nil
+}
+
+func (session *Session) ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.embeds = append(session.embeds, SentEmbed{ChannelID: channelID, Embed: embed})
+	return &discordgo.Message{ID: fmt.Sprint(session.newID()), ChannelID: channelID, Embeds: []*discordgo.MessageEmbed{embed}}, nil
+}
+
+func (session *Session) ChannelFileSend(channelID, name string, r io.Reader) (*discordgo.Message, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.files = append(session.files, SentFile{ChannelID: channelID, Name: name, Data: data})
+	return &discordgo.Message{ID: fmt.Sprint(session.newID()), ChannelID: channelID}, nil
+}
+
+func (session *Session) MessageReactionAdd(channelID, messageID, emojiID string) error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.reactions = append(session.reactions, Reaction{ChannelID: channelID, MessageID: messageID, Emoji: emojiID})
+	return nil
+}
+
+func (session *Session) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	member, ok := session.members[guildID+"/"+userID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown member %s of guild %s", userID, guildID)
+	}
+	return member, nil
+}
+
+// SetMember makes userID a member of guildID with the given role IDs.
+func (session *Session) SetMember(guildID, userID string, roles ...string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.members[guildID+"/"+userID] = &discordgo.Member{
+		GuildID: guildID,
+		User:    &discordgo.User{ID: userID},
+		Roles:   roles,
+	}
+}
+
+func (session *Session) GuildRoles(guildID string) ([]*discordgo.Role, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.roles[guildID], nil
+}
+
+// AddRole adds a role to guildID, later roles rank higher.
+func (session *Session) AddRole(guildID, roleID string, color int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.roles[guildID] = append(session.roles[guildID], &discordgo.Role{
+		ID:       roleID,
+		Color:    color,
+		Position: len(session.roles[guildID]) + 1,
+	})
+}
+
+// Messages returns a snapshot of every plain message sent.
+func (session *Session) Messages() []SentMessage {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return append([]SentMessage(nil), session.messages...)
+}
+
+// Embeds returns a snapshot of every embed sent.
+func (session *Session) Embeds() []SentEmbed {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return append([]SentEmbed(nil), session.embeds...)
+}
+
+// Files returns a snapshot of every file uploaded.
+func (session *Session) Files() []SentFile {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return append([]SentFile(nil), session.files...)
+}
+
+// Reactions returns a snapshot of every reaction added.
+func (session *Session) Reactions() []Reaction {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return append([]Reaction(nil), session.reactions...)
+}
+
+// ReactionsOn returns the emoji added to a single message.
+func (session *Session) ReactionsOn(messageID string) []string {
+	var emoji []string
+	for _, reaction := range session.Reactions() {
+		if reaction.MessageID == messageID {
+			emoji = append(emoji, reaction.Emoji)
+		}
+	}
+	return emoji
+}
+
+// NewMessage builds a MessageCreate event from a user in a channel outside any guild.
+func (session *Session) NewMessage(channelID, userID, username, content string) *discordgo.MessageCreate {
+	return session.NewGuildMessage("", channelID, userID, username, content)
+}
+
+// NewGuildMessage builds a MessageCreate event from a user in a guild channel.
+func (session *Session) NewGuildMessage(guildID, channelID, userID, username, content string) *discordgo.MessageCreate {
+	session.mutex.Lock()
+	id := session.newID()
+	session.mutex.Unlock()
+	return &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        fmt.Sprint(id),
+		GuildID:   guildID,
+		ChannelID: channelID,
+		Content:   content,
+		Author:    &discordgo.User{ID: userID, Username: username, Discriminator: "0001"},
+	}}
+}
+
+// Inject delivers m to every registered MessageCreate handler.
+func (session *Session) Inject(m *discordgo.MessageCreate) {
+	session.mutex.Lock()
+	handlers := make([]func(*discordgo.Session, *discordgo.MessageCreate), 0, len(session.handlers))
+	for _, handler := range session.handlers {
+		handlers = append(handlers, handler)
+	}
+	session.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(nil, m)
+	}
+}
+
+// WaitFor polls cond until it returns true or timeout elapses. Handlers run
+// asynchronously, so tests use this to wait for their side effects.
+func (session *Session) WaitFor(cond func(*Session) bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cond(session) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (session *Session) newID() int {
+	session.nextID++
+	return session.nextID
+}
@@ -0,0 +1,140 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	chart "github.com/wcharczuk/go-chart/v2"
+)
+
+const (
+	DefaultGraphPeriod = "24h"
+	GraphWidth         = 1024
+	GraphHeight        = 512
+)
+
+// handleGraph uploads a chart of a server's tps, players or memory: graph {server} {metric} [period].
+func (discord *DiscordHandler) handleGraph(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if discord.statushistory == nil {
+		return errors.New("No status history")
+	}
+	args := strings.Fields(data)
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New("Graph needs {server} tps|players|memory [24h|7d]")
+	}
+	if !discord.guildConfig(m.GuildID).Sees(args[0]) || !discord.serverExists(args[0]) {
+		return fmt.Errorf("Could not find a server of name %s", args[0])
+	}
+	period := DefaultGraphPeriod
+	if len(args) > 2 {
+		period = args[2]
+	}
+	now := time.Now()
+	since, err := ParseSince(period, now)
+	if err != nil {
+		return err
+	}
+	samples, err := discord.statushistory.Query(discord.findServer(args[0]).Id(), since)
+	if err != nil {
+		return err
+	}
+	if len(samples) < 2 {
+		return fmt.Errorf("Not enough status history of %s to graph yet", args[0])
+	}
+
+	graph := chart.Chart{
+		Title:  fmt.Sprintf("%s %s, last %s", args[0], args[1], period),
+		Width:  GraphWidth,
+		Height: GraphHeight,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 50, Left: 20, Right: 20, Bottom: 20},
+		},
+		XAxis: chart.XAxis{ValueFormatter: timeFormatter(now.Sub(since))},
+	}
+	switch args[1] {
+	case "tps":
+		graph.Series = tpsSeries(samples)
+		graph.YAxis = chart.YAxis{Name: "TPS", Range: &chart.ContinuousRange{Min: 0, Max: 20}}
+		// Players on the second axis show whether lag follows the player count.
+		players := sampleSeries("players", samples, func(sample api.StatusSample) float64 { return float64(sample.Players) })
+		players.YAxis = chart.YAxisSecondary
+		players.Style = chart.Style{StrokeColor: chart.ColorAlternateGray, StrokeDashArray: []float64{5, 5}}
+		graph.Series = append(graph.Series, players)
+		graph.YAxisSecondary = chart.YAxis{Name: "Players", ValueFormatter: chart.IntValueFormatter}
+	case "players":
+		graph.Series = []chart.Series{sampleSeries("players", samples, func(sample api.StatusSample) float64 { return float64(sample.Players) })}
+		graph.YAxis = chart.YAxis{Name: "Players", ValueFormatter: chart.IntValueFormatter}
+	case "memory":
+		graph.Series = []chart.Series{
+			sampleSeries("used", samples, func(sample api.StatusSample) float64 { return float64(sample.Memory) }),
+			sampleSeries("max", samples, func(sample api.StatusSample) float64 { return float64(sample.MemoryMax) }),
+		}
+		graph.YAxis = chart.YAxis{Name: "Memory", ValueFormatter: chart.IntValueFormatter}
+	default:
+		return fmt.Errorf("Cannot graph %s, use tps, players or memory", args[1])
+	}
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+
+	var image bytes.Buffer
+	if err = graph.Render(chart.PNG, &image); err != nil {
+		return err
+	}
+	_, err = discord.session.ChannelFileSend(m.ChannelID, fmt.Sprintf("%s-%s.png", args[0], args[1]), &image)
+	return err
+}
+
+func sampleSeries(name string, samples []api.StatusSample, value func(sample api.StatusSample) float64) chart.TimeSeries {
+	series := chart.TimeSeries{Name: name}
+	for _, sample := range samples {
+		series.XValues = append(series.XValues, sample.Time)
+		series.YValues = append(series.YValues, value(sample))
+	}
+	return series
+}
+
+// tpsSeries draws a line for every dimension that appears in the samples.
+func tpsSeries(samples []api.StatusSample) []chart.Series {
+	var dimensions []int
+	seen := make(map[int]bool)
+	for _, sample := range samples {
+		for dimension := range sample.Tps {
+			if !seen[dimension] {
+				seen[dimension] = true
+				dimensions = append(dimensions, dimension)
+			}
+		}
+	}
+	sort.Ints(dimensions)
+	var series []chart.Series
+	for _, dimension := range dimensions {
+		line := chart.TimeSeries{Name: dimensionName(dimension)}
+		for _, sample := range samples {
+			if tps, ok := sample.Tps[dimension]; ok {
+				line.XValues = append(line.XValues, sample.Time)
+				line.YValues = append(line.YValues, float64(tps))
+			}
+		}
+		// A line needs two points, dimensions loaded only briefly are left out.
+		if len(line.XValues) > 1 {
+			series = append(series, line)
+		}
+	}
+	return series
+}
+
+// timeFormatter labels the time axis with hours for a day or less, dates beyond that.
+func timeFormatter(period time.Duration) chart.ValueFormatter {
+	if period <= 24*time.Hour {
+		return chart.TimeValueFormatterWithFormat("15:04")
+	}
+	return chart.TimeValueFormatterWithFormat("Jan 2 15:04")
+}
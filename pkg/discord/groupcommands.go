@@ -0,0 +1,141 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+// targetServers returns the servers visible from the guild that target names, by name or
+// as group:<tag>. No target means every visible server.
+func (discord *DiscordHandler) targetServers(m *discordgo.MessageCreate, target string) ([]api.IServer, error) {
+	var servers []api.IServer
+	for _, server := range discord.guildServers(m.GuildID) {
+		if target == "" || api.MatchesTarget(server.Name(), server.Tags(), target) {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 && target != "" {
+		return nil, fmt.Errorf("Could not find a server or group of name %s", target)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name() < servers[j].Name() })
+	return servers, nil
+}
+
+// handleTag sets the groups of a server, no tags takes it out of every group: tag {server} [tag,...].
+func (discord *DiscordHandler) handleTag(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	args := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	if args[0] == "" {
+		return errors.New("Tag needs {server} [tag,...]")
+	}
+	if !discord.guildConfig(m.GuildID).Sees(args[0]) || !discord.serverExists(args[0]) {
+		return fmt.Errorf("Could not find a server of name %s", args[0])
+	}
+	var tags []string
+	if len(args) > 1 {
+		for _, tag := range strings.Split(args[1], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return discord.serverhandler.SetServerTags(args[0], tags)
+}
+
+// handleStatus shows the last status of a server, a group, or every server the guild sees.
+func (discord *DiscordHandler) handleStatus(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	servers, err := discord.targetServers(m, strings.TrimSpace(data))
+	if err != nil {
+		return err
+	}
+	var fields []*discordgo.MessageEmbedField
+	for _, server := range servers {
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:  serverTitle(server),
+			Value: formatStatus(server),
+		})
+	}
+	embed := &discordgo.MessageEmbed{
+		Author:    &discordgo.MessageEmbedAuthor{},
+		Color:     0x00ff00,
+		Fields:    fields,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Title:     "Server Status",
+	}
+	_, err = discord.session.ChannelMessageSendEmbed(m.ChannelID, embed)
+	return err
+}
+
+// serverTitle is a server's name followed by its groups.
+func serverTitle(server api.IServer) string {
+	if tags := server.Tags(); len(tags) > 0 {
+		return fmt.Sprintf("%s [%s]", server.Name(), strings.Join(tags, ", "))
+	}
+	return server.Name()
+}
+
+func formatStatus(server api.IServer) string {
+	parts := []string{server.Status().String()}
+	data := server.Data()
+	if data.PlayerMax > 0 || len(data.Players) > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d players", len(data.Players), data.PlayerMax))
+	}
+	if tps, ok := data.Tps[0]; ok {
+		parts = append(parts, fmt.Sprintf("%.1f TPS", tps))
+	}
+	if data.MemoryMax > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d MB", data.Memory, data.MemoryMax))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// handleBroadcast announces a message in game on a server or group: broadcast {server|group:<tag>} {message}.
+func (discord *DiscordHandler) handleBroadcast(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	args := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	if len(args) < 2 {
+		return errors.New("Broadcast needs {server|group:<tag>} {message}")
+	}
+	servers, err := discord.targetServers(m, args[0])
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, server := range servers {
+		names = append(names, server.Name())
+	}
+
+	command := api.Command{Command: "say " + api.SayText(args[1]), Source: DiscordSource + m.Author.String()}
+	if err = discord.commandPolicy(m).Check(command.Command); err != nil {
+		discord.auditCommand(api.CommandAudit{Command: command.Command, Source: command.Source, Reason: err.Error()})
+		return err
+	}
+	var header api.Header
+	if err = api.MarshalCommandToHeader(&command, &header); err != nil {
+		return err
+	}
+	discord.auditCommand(api.CommandAudit{Command: command.Command, Source: command.Source, Allowed: true})
+	summary := discord.serverhandler.SendPacketToServers(header, names)
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Broadcast delivered to %d of %d servers.",
+		summary.Count(api.Delivered), len(summary.Results)))
+	return err
+}
@@ -0,0 +1,481 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	GuildPrefix = "guild."
+)
+
+// GuildConfig is one guild's view of the shared servers.
+type GuildConfig struct {
+	ChannelId string `json:"channelId"`
+	// ControlChar overrides the handler's default when set.
+	ControlChar string `json:"controlChar"`
+	// AdminRoles may change servers and config, anyone in the relay channel may if it is empty.
+	AdminRoles []string `json:"adminRoles"`
+	// Servers limits which servers the guild relays to and lists, all of them if it is empty.
+	// Entries are server IDs, names or group:<tag>, servers linked with !link are kept by ID.
+	Servers []string `json:"servers"`
+	// ModLogChannel receives every audit entry from this guild, and those from outside any guild.
+	ModLogChannel string `json:"modLogChannel"`
+	// CommandRoles maps a role ID to the console command patterns its members may run.
+	CommandRoles map[string][]string `json:"commandRoles"`
+	// AlertChannel receives TPS and memory alerts for the servers the guild sees.
+	AlertChannel string `json:"alertChannel"`
+	// AlertRoles are mentioned when an alert fires.
+	AlertRoles []string `json:"alertRoles"`
+
+	// findServer looks a server up by ID or name, it is filled in by guildConfig.
+	findServer func(server string) api.IServer
+}
+
+// Sees reports whether a server, given by ID or name, is part of the guild's view.
+func (guild GuildConfig) Sees(server string) bool {
+	if len(guild.Servers) == 0 {
+		return true
+	}
+	id, name, tags := server, server, []string(nil)
+	if guild.findServer != nil {
+		if found := guild.findServer(server); found != nil {
+			id, name, tags = found.Id(), found.Name(), found.Tags()
+		}
+	}
+	for _, target := range guild.Servers {
+		if target == id || api.MatchesTarget(name, tags, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// guildOptions lists the values a guild can change for itself with !config set guild.<name>.
+func guildOptions() []api.ConfigOption {
+	return []api.ConfigOption{
+		api.StringOption(GuildPrefix+"channelId", "Channel relayed to this guild's servers.", "", isSnowflake),
+		api.StringOption(GuildPrefix+"controlChar", "Prefix for bot commands in this guild, empty uses the default.", "", func(value string) error {
+			if strings.IndexFunc(value, unicode.IsSpace) >= 0 {
+				return errors.New("controlChar must not contain spaces")
+			}
+			return nil
+		}),
+		api.StringOption(GuildPrefix+"modLogChannel", "Channel audit entries are posted to.", "", isSnowflake),
+		api.ListOption(GuildPrefix+"adminRoles", "Role IDs allowed to change servers and config, comma separated.", isSnowflake),
+		api.ListOption(GuildPrefix+"servers", "Servers or group:<tag> this guild sees, comma separated, empty for all.", validateTarget),
+		api.StringOption(GuildPrefix+"alertChannel", "Channel TPS and memory alerts are posted to.", "", isSnowflake),
+		api.ListOption(GuildPrefix+"alertRoles", "Role IDs mentioned when an alert fires, comma separated.", isSnowflake),
+	}
+}
+
+// validateTarget accepts a server name or a group:<tag>.
+func validateTarget(value string) error {
+	if strings.HasPrefix(value, api.GroupPrefix) {
+		return api.ValidateTag(strings.TrimPrefix(value, api.GroupPrefix))
+	}
+	if value == "" {
+		return errors.New("Server name must not be empty")
+	}
+	return nil
+}
+
+func isSnowflake(value string) error {
+	if value == "" {
+		return errors.New("ID must not be empty")
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return fmt.Errorf("%s is not a Discord ID", value)
+		}
+	}
+	return nil
+}
+
+// guildConfig returns the config for guildID with defaults filled in. A guild that has
+// not been set up yet falls back to the single channel from older configs.
+func (discord *DiscordHandler) guildConfig(guildID string) GuildConfig {
+	config := discord.currentConfig()
+	guild, ok := config.Guilds[guildID]
+	if !ok {
+		guild.ChannelId = config.ChannelId
+	}
+	if guild.ControlChar == "" {
+		guild.ControlChar = config.ControlChar
+	}
+	guild.findServer = discord.findServer
+	return guild
+}
+
+// findServer returns the server with the given ID or name, nil if there is none.
+func (discord *DiscordHandler) findServer(server string) api.IServer {
+	if discord.serverhandler == nil {
+		return nil
+	}
+	var named api.IServer
+	for _, found := range discord.serverhandler.Servers() {
+		if found.Id() == server {
+			return found
+		}
+		if found.Name() == server {
+			named = found
+		}
+	}
+	return named
+}
+
+// serverName shows a server that data is stored by under its current name. Data from
+// before servers had IDs, or of servers since removed, shows what it was stored under.
+func (discord *DiscordHandler) serverName(id string) string {
+	if server := discord.findServer(id); server != nil {
+		return server.Name()
+	}
+	return id
+}
+
+// updateGuild changes a guild's config through a copy, so readers holding the old map are unaffected.
+func (discord *DiscordHandler) updateGuild(guildID string, update func(guild *GuildConfig)) {
+	discord.configMutex.Lock()
+	defer discord.configMutex.Unlock()
+	guilds := make(map[string]GuildConfig, len(discord.config.Guilds)+1)
+	for id, guild := range discord.config.Guilds {
+		guilds[id] = guild
+	}
+	guild := guilds[guildID]
+	update(&guild)
+	guilds[guildID] = guild
+	discord.config.Guilds = guilds
+}
+
+// adoptLegacyChannel moves the single relay channel of older configs into the guild it
+// turns out to belong to, the first time a message arrives there.
+func (discord *DiscordHandler) adoptLegacyChannel(m *discordgo.MessageCreate) {
+	config := discord.currentConfig()
+	if m.GuildID == "" || config.ChannelId == "" || config.ChannelId != m.ChannelID {
+		return
+	}
+	if _, ok := config.Guilds[m.GuildID]; ok {
+		return
+	}
+	discord.updateGuild(m.GuildID, func(guild *GuildConfig) {
+		guild.ChannelId = config.ChannelId
+	})
+	discord.configMutex.Lock()
+	discord.config.ChannelId = ""
+	discord.configMutex.Unlock()
+	fmt.Println("Relay channel", m.ChannelID, "now belongs to guild", m.GuildID)
+	if err := discord.masterconfig.Write(); err != nil {
+		fmt.Println("Error writing config,", err)
+	}
+}
+
+// relayChannels lists every channel that should see chat from server.
+func (discord *DiscordHandler) relayChannels(server string) []string {
+	config := discord.currentConfig()
+	var channels []string
+	if config.ChannelId != "" {
+		channels = append(channels, config.ChannelId)
+	}
+	for _, guild := range config.Guilds {
+		guild.findServer = discord.findServer
+		if guild.ChannelId != "" && guild.Sees(server) {
+			channels = append(channels, guild.ChannelId)
+		}
+	}
+	return channels
+}
+
+// allChannels lists every relay channel regardless of the servers each guild sees.
+func (discord *DiscordHandler) allChannels() []string {
+	config := discord.currentConfig()
+	var channels []string
+	if config.ChannelId != "" {
+		channels = append(channels, config.ChannelId)
+	}
+	for _, guild := range config.Guilds {
+		if guild.ChannelId != "" {
+			channels = append(channels, guild.ChannelId)
+		}
+	}
+	return channels
+}
+
+// checkChannel rejects commands sent outside the guild's relay channel.
+func (discord *DiscordHandler) checkChannel(m *discordgo.MessageCreate) error {
+	if discord.guildConfig(m.GuildID).ChannelId != m.ChannelID {
+		return errors.New("Wrong channel")
+	}
+	return nil
+}
+
+// checkAdmin rejects commands from members without one of the guild's admin roles.
+func (discord *DiscordHandler) checkAdmin(m *discordgo.MessageCreate) error {
+	guild := discord.guildConfig(m.GuildID)
+	if len(guild.AdminRoles) == 0 {
+		return nil
+	}
+	member, err := discord.session.GuildMember(m.GuildID, m.Author.ID)
+	if err != nil {
+		fmt.Println("Error looking up guild member,", err)
+		return errors.New("Missing permission")
+	}
+	for _, role := range member.Roles {
+		for _, admin := range guild.AdminRoles {
+			if role == admin {
+				return nil
+			}
+		}
+	}
+	return errors.New("Missing permission")
+}
+
+// checkGlobalAdmin limits changes to what every guild shares. With adminUsers set only those
+// users may make them, otherwise the guild's admins may as long as no other guild is set up.
+func (discord *DiscordHandler) checkGlobalAdmin(m *discordgo.MessageCreate) error {
+	config := discord.currentConfig()
+	if len(config.AdminUsers) > 0 {
+		if containsString(config.AdminUsers, m.Author.ID) {
+			return nil
+		}
+		return errors.New("Missing permission, this changes every guild")
+	}
+	if discord.hasOtherGuilds(m.GuildID) {
+		return errors.New("Changing what every guild shares needs discord.adminUsers to be set")
+	}
+	return discord.checkAdmin(m)
+}
+
+// hasOtherGuilds reports whether a guild other than guildID is set up.
+func (discord *DiscordHandler) hasOtherGuilds(guildID string) bool {
+	for id := range discord.currentConfig().Guilds {
+		if id != guildID {
+			return true
+		}
+	}
+	return false
+}
+
+// guildServers returns the servers visible from a guild.
+func (discord *DiscordHandler) guildServers(guildID string) map[api.NetLocation]api.IServer {
+	guild := discord.guildConfig(guildID)
+	servers := discord.serverhandler.Servers()
+	for loc, server := range servers {
+		if !guild.Sees(server.Name()) {
+			delete(servers, loc)
+		}
+	}
+	return servers
+}
+
+// handleLink adds a shared server to this guild's view.
+func (discord *DiscordHandler) handleLink(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	target := strings.TrimSpace(data)
+	if strings.HasPrefix(target, api.GroupPrefix) {
+		if err := validateTarget(target); err != nil {
+			return err
+		}
+	} else if !discord.serverExists(target) {
+		return fmt.Errorf("Could not find a server of name %s", target)
+	} else {
+		// Linked by ID, so the link survives a rename.
+		target = discord.findServer(target).Id()
+	}
+	if len(discord.guildConfig(m.GuildID).Servers) == 0 {
+		return errors.New("This guild already sees every server")
+	}
+	discord.updateGuild(m.GuildID, func(guild *GuildConfig) {
+		if !containsString(guild.Servers, target) {
+			guild.Servers = append(append([]string(nil), guild.Servers...), target)
+		}
+	})
+	return discord.masterconfig.Write()
+}
+
+// handleUnlink removes a server from this guild's view, a guild that sees every server
+// starts seeing only the rest.
+func (discord *DiscordHandler) handleUnlink(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	name := strings.TrimSpace(data)
+	guild := discord.guildConfig(m.GuildID)
+	var remaining []string
+	var server api.IServer
+	if strings.HasPrefix(name, api.GroupPrefix) {
+		if !containsString(guild.Servers, name) {
+			return fmt.Errorf("This guild is not linked to %s", name)
+		}
+	} else if !guild.Sees(name) || !discord.serverExists(name) {
+		return fmt.Errorf("This guild does not see a server of name %s", name)
+	} else {
+		server = discord.findServer(name)
+	}
+	if len(guild.Servers) == 0 {
+		for _, other := range discord.guildServers(m.GuildID) {
+			if other.Id() != server.Id() {
+				remaining = append(remaining, other.Id())
+			}
+		}
+	} else {
+		for _, target := range guild.Servers {
+			if target != name && (server == nil || !refersTo(target, server)) {
+				remaining = append(remaining, target)
+			}
+		}
+		guild.Servers = remaining
+		if len(remaining) > 0 && guild.Sees(name) {
+			return fmt.Errorf("%s is seen through a group, unlink the group instead", name)
+		}
+	}
+	if len(remaining) == 0 {
+		return errors.New("Cannot unlink the last server, the guild would see every server")
+	}
+	discord.updateGuild(m.GuildID, func(guild *GuildConfig) {
+		guild.Servers = remaining
+	})
+	return discord.masterconfig.Write()
+}
+
+// forgetServer drops a removed server from every guild's view.
+func (discord *DiscordHandler) forgetServer(server api.IServer) {
+	for id, guild := range discord.currentConfig().Guilds {
+		var servers []string
+		for _, target := range guild.Servers {
+			if !refersTo(target, server) {
+				servers = append(servers, target)
+			}
+		}
+		if len(servers) == len(guild.Servers) {
+			continue
+		}
+		discord.updateGuild(id, func(guild *GuildConfig) {
+			guild.Servers = servers
+		})
+	}
+}
+
+// refersTo reports whether a guild view entry names server, by ID or by name.
+func refersTo(target string, server api.IServer) bool {
+	return target == server.Id() || target == server.Name()
+}
+
+// sharedWithOtherGuilds reports whether a guild other than guildID sees the named server.
+func (discord *DiscordHandler) sharedWithOtherGuilds(name string, guildID string) bool {
+	for id, guild := range discord.currentConfig().Guilds {
+		guild.findServer = discord.findServer
+		if id != guildID && guild.Sees(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (discord *DiscordHandler) serverExists(name string) bool {
+	for _, server := range discord.serverhandler.Servers() {
+		if server.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RenameServer points guild views and alert rules that name a server at its ID, everything
+// else is kept by ID already. Once they hold the ID, renames made together, such as two
+// servers swapping names, cannot mix them up. The server handler writes the config once
+// every RenameHandler has run.
+func (discord *DiscordHandler) RenameServer(oldName string, newName string) {
+	target := newName
+	if server := discord.findServer(newName); server != nil {
+		target = server.Id()
+	}
+	for id, guild := range discord.currentConfig().Guilds {
+		if !containsString(guild.Servers, oldName) {
+			continue
+		}
+		discord.updateGuild(id, func(guild *GuildConfig) {
+			servers := make([]string, len(guild.Servers))
+			for i, server := range guild.Servers {
+				servers[i] = server
+				if server == oldName {
+					servers[i] = target
+				}
+			}
+			guild.Servers = servers
+		})
+	}
+	discord.updateAlerts(func(alerts *AlertConfig) error {
+		for i, rule := range alerts.Rules {
+			if rule.Server == oldName {
+				alerts.Rules[i].Server = target
+			}
+		}
+		return nil
+	})
+}
+
+// handleRename gives a server this guild sees a new name: rename {server} {new name}.
+func (discord *DiscordHandler) handleRename(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	args := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	if len(args) < 2 {
+		return errors.New("Rename needs {server} {new name}")
+	}
+	newName := strings.TrimSpace(args[1])
+	if !discord.guildConfig(m.GuildID).Sees(args[0]) || !discord.serverExists(args[0]) {
+		return fmt.Errorf("Could not find a server of name %s", args[0])
+	}
+	if discord.sharedWithOtherGuilds(args[0], m.GuildID) {
+		if err := discord.checkGlobalAdmin(m); err != nil {
+			return err
+		}
+	}
+	return discord.serverhandler.RenameServer(args[0], newName)
+}
+
+// handleMove reconnects a server this guild sees at a new address: move {server} {host[:port]}.
+func (discord *DiscordHandler) handleMove(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	data = strings.TrimSpace(data)
+	split := strings.LastIndex(data, " ")
+	if split < 0 {
+		return errors.New("Move needs {server} {host[:port]}")
+	}
+	name := strings.TrimSpace(data[:split])
+	if !discord.guildConfig(m.GuildID).Sees(name) || !discord.serverExists(name) {
+		return fmt.Errorf("Could not find a server of name %s", name)
+	}
+	if discord.sharedWithOtherGuilds(name, m.GuildID) {
+		if err := discord.checkGlobalAdmin(m); err != nil {
+			return err
+		}
+	}
+	location, err := discord.serverhandler.ResolveLocation(data[split+1:])
+	if err != nil {
+		return err
+	}
+	return discord.serverhandler.MoveServer(name, *location)
+}
@@ -0,0 +1,179 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/history"
+)
+
+const (
+	HistoryLimit = 25
+)
+
+// recordGame stores chat relayed from a server.
+func (discord *DiscordHandler) recordGame(i api.MessageWithSender) {
+	if discord.chathistory == nil {
+		return
+	}
+	player, message := history.ParseChat(i.Message)
+	record := api.ChatRecord{Servers: []string{i.ServerId}, Player: player, Message: message}
+	if err := discord.chathistory.Add(record); err != nil {
+		fmt.Println("Error storing chat history,", err)
+	}
+}
+
+// recordDiscord stores chat relayed from Discord along with the servers it reached.
+func (discord *DiscordHandler) recordDiscord(o api.MessageWithSender, summary api.DeliverySummary) {
+	if discord.chathistory == nil {
+		return
+	}
+	var servers []string
+	for _, result := range summary.Results {
+		if result.Status != api.Dropped && !containsString(servers, result.Id) {
+			servers = append(servers, result.Id)
+		}
+	}
+	record := api.ChatRecord{
+		Servers:       servers,
+		DiscordUser:   o.Sender,
+		DiscordUserId: o.SenderId,
+		GuildId:       o.GuildId,
+		Message:       o.Message,
+	}
+	if err := discord.chathistory.Add(record); err != nil {
+		fmt.Println("Error storing chat history,", err)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHistory shows recent chat on a server, optionally from one player and after a time.
+func (discord *DiscordHandler) handleHistory(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkHistory(m); err != nil {
+		return err
+	}
+	args := strings.Fields(data)
+	if len(args) < 1 || len(args) > 3 {
+		return errors.New("History needs {server} [player] [since]")
+	}
+	if !discord.guildConfig(m.GuildID).Sees(args[0]) || !discord.serverExists(args[0]) {
+		return fmt.Errorf("Could not find a server of name %s", args[0])
+	}
+	query := api.ChatQuery{Server: discord.findServer(args[0]).Id(), Limit: HistoryLimit}
+	rest := args[1:]
+	if len(rest) > 0 {
+		if since, err := ParseSince(rest[len(rest)-1], time.Now()); err == nil {
+			query.Since = since
+			rest = rest[:len(rest)-1]
+		} else if len(rest) == 2 {
+			return err
+		}
+	}
+	if len(rest) > 0 {
+		query.Player = rest[0]
+	}
+	return discord.sendHistory(query, m)
+}
+
+// handleSearch finds recent chat containing some text on any server the guild sees.
+func (discord *DiscordHandler) handleSearch(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkHistory(m); err != nil {
+		return err
+	}
+	text := strings.TrimSpace(data)
+	if text == "" {
+		return errors.New("Search needs {text}")
+	}
+	guild := discord.guildConfig(m.GuildID)
+	query := api.ChatQuery{
+		Text:  text,
+		Limit: HistoryLimit,
+		Filter: func(record api.ChatRecord) bool {
+			for _, server := range record.Servers {
+				if guild.Sees(server) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return discord.sendHistory(query, m)
+}
+
+// checkHistory limits chat history to moderators in the relay channel.
+func (discord *DiscordHandler) checkHistory(m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if err := discord.checkAdmin(m); err != nil {
+		return err
+	}
+	if discord.chathistory == nil {
+		return errors.New("No chat history")
+	}
+	return nil
+}
+
+func (discord *DiscordHandler) sendHistory(query api.ChatQuery, m *discordgo.MessageCreate) error {
+	records, err := discord.chathistory.Query(query)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, record := range records {
+		lines = append(lines, discord.formatChatRecord(record))
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No messages found.")
+	}
+	for _, chunk := range SplitMessage(strings.Join(lines, "\n"), DiscordMessageLimit) {
+		if _, err = discord.session.ChannelMessageSend(m.ChannelID, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (discord *DiscordHandler) formatChatRecord(record api.ChatRecord) string {
+	from := record.Player
+	if record.DiscordUser != "" {
+		from = "@" + record.DiscordUser
+	}
+	if from == "" {
+		from = "*"
+	}
+	var servers []string
+	for _, id := range record.Servers {
+		servers = append(servers, discord.serverName(id))
+	}
+	return fmt.Sprintf("%s [%s] %s: %s", record.Time.Format("2006-01-02 15:04:05"), strings.Join(servers, ","), from, record.Message)
+}
+
+// ParseSince reads a time either as an age such as 30m, 12h or 7d, or as a date 2006-01-02.
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return now.Add(-age), nil
+	}
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("Could not read %s as a time, use e.g. 2h, 7d or 2006-01-02", value)
+}
@@ -0,0 +1,139 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	TopLimit = 10
+)
+
+// handlePlaytime shows a player's time on each server the guild sees.
+func (discord *DiscordHandler) handlePlaytime(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkPlayers(m); err != nil {
+		return err
+	}
+	player := strings.TrimSpace(data)
+	if player == "" {
+		return errors.New("Playtime needs {player}")
+	}
+	times, err := discord.sessions.Playtime(player, time.Time{})
+	if err != nil {
+		return err
+	}
+	guild := discord.guildConfig(m.GuildID)
+	var total time.Duration
+	var lines []string
+	for _, t := range times {
+		if guild.Sees(t.Server) {
+			total += t.Time
+			lines = append(lines, fmt.Sprintf("%s: %s", discord.serverName(t.Server), formatDuration(t.Time)))
+		}
+	}
+	text := fmt.Sprintf("%s has no recorded playtime.", player)
+	if total > 0 {
+		text = fmt.Sprintf("%s has played %s.\n%s", player, formatDuration(total), strings.Join(lines, "\n"))
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, text)
+	return err
+}
+
+// handleTop ranks players, only playtime is ranked for now: top playtime [server] [period].
+func (discord *DiscordHandler) handleTop(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkPlayers(m); err != nil {
+		return err
+	}
+	args := strings.Fields(data)
+	if len(args) < 1 || args[0] != "playtime" || len(args) > 3 {
+		return errors.New("Top needs playtime [server] [period]")
+	}
+	var server api.IServer
+	var since time.Time
+	period := "all time"
+	for _, arg := range args[1:] {
+		if arg == "all" {
+			continue
+		}
+		if t, err := ParseSince(arg, time.Now()); err == nil {
+			since, period = t, "the last "+arg
+		} else if discord.guildConfig(m.GuildID).Sees(arg) && discord.serverExists(arg) {
+			server = discord.findServer(arg)
+		} else {
+			return fmt.Errorf("Could not find a server of name %s", arg)
+		}
+	}
+
+	guild := discord.guildConfig(m.GuildID)
+	where, id := "all servers", ""
+	if server != nil {
+		where, id = server.Name(), server.Id()
+	}
+	times, err := discord.sessions.Top(id, since, TopLimit, guild.Sees)
+	if err != nil {
+		return err
+	}
+	lines := []string{fmt.Sprintf("Top playtime on %s for %s:", where, period)}
+	for i, t := range times {
+		lines = append(lines, fmt.Sprintf("%d. %s %s", i+1, t.Player, formatDuration(t.Time)))
+	}
+	if len(times) == 0 {
+		lines = append(lines, "No playtime recorded.")
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, strings.Join(lines, "\n"))
+	return err
+}
+
+// handleSeen shows when a player was last online on a server the guild sees.
+func (discord *DiscordHandler) handleSeen(data string, m *discordgo.MessageCreate) error {
+	if err := discord.checkPlayers(m); err != nil {
+		return err
+	}
+	player := strings.TrimSpace(data)
+	if player == "" {
+		return errors.New("Seen needs {player}")
+	}
+	seen, err := discord.sessions.Seen(player, discord.guildConfig(m.GuildID).Sees)
+	if err != nil {
+		return err
+	}
+	text := fmt.Sprintf("%s has not been seen.", player)
+	if seen != nil {
+		if seen.Online {
+			text = fmt.Sprintf("%s is online on %s.", seen.Player, discord.serverName(seen.Server))
+		} else {
+			text = fmt.Sprintf("%s was last seen on %s %s ago.", seen.Player, discord.serverName(seen.Server), formatDuration(time.Since(seen.Time)))
+		}
+	}
+	_, err = discord.session.ChannelMessageSend(m.ChannelID, text)
+	return err
+}
+
+func (discord *DiscordHandler) checkPlayers(m *discordgo.MessageCreate) error {
+	if err := discord.checkChannel(m); err != nil {
+		return err
+	}
+	if discord.sessions == nil {
+		return errors.New("No player sessions")
+	}
+	return nil
+}
+
+// formatDuration shows a duration in days, hours and minutes.
+func formatDuration(d time.Duration) string {
+	minutes := int(d.Minutes())
+	days, hours := minutes/(24*60), minutes/60%24
+	minutes %= 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
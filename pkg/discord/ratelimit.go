@@ -0,0 +1,114 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+// RateLimitConfig sets how fast chat may be relayed in each direction. A rate of 0 turns that limit off.
+type RateLimitConfig struct {
+	UserBurst       int `json:"userBurst"`
+	UserPerMinute   int `json:"userPerMinute"`
+	ServerBurst     int `json:"serverBurst"`
+	ServerPerMinute int `json:"serverPerMinute"`
+	// BatchMillis is how long in-game lines are collected before being posted as one message.
+	BatchMillis int `json:"batchMillis"`
+	// BatchMaxLines caps the lines held for a throttled server, the oldest are dropped past it.
+	BatchMaxLines int `json:"batchMaxLines"`
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		UserBurst:       5,
+		UserPerMinute:   20,
+		ServerBurst:     5,
+		ServerPerMinute: 30,
+		BatchMillis:     1000,
+		BatchMaxLines:   50,
+	}
+}
+
+func rateLimitOptions() []api.ConfigOption {
+	defaults := DefaultRateLimitConfig()
+	path := ConfigKey + ".rateLimit."
+	return []api.ConfigOption{
+		api.IntOption(path+"userBurst", "Messages a Discord user may send at once.", defaults.UserBurst, 1, 1000),
+		api.IntOption(path+"userPerMinute", "Messages a Discord user may relay per minute, 0 for no limit.", defaults.UserPerMinute, 0, 6000),
+		api.IntOption(path+"serverBurst", "Discord messages a server may cause at once.", defaults.ServerBurst, 1, 1000),
+		api.IntOption(path+"serverPerMinute", "Discord messages a server may cause per minute, 0 for no limit.", defaults.ServerPerMinute, 0, 6000),
+		api.IntOption(path+"batchMillis", "Milliseconds in-game lines are collected into one message.", defaults.BatchMillis, 10, 60000),
+		api.IntOption(path+"batchMaxLines", "Lines held for a throttled server before the oldest are dropped.", defaults.BatchMaxLines, 1, 10000),
+	}
+}
+
+type tokenBucket struct {
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+// rateLimiter keeps one token bucket per key, e.g. per Discord user or per server.
+type rateLimiter struct {
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow takes a token from key's bucket. started is true only for the first refusal
+// after a run of allowed calls, so callers can post a single notice.
+func (limiter *rateLimiter) Allow(key string, burst int, perMinute int) (allowed bool, started bool) {
+	if perMinute <= 0 {
+		return true, false
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Minutes() * float64(perMinute)
+	if bucket.tokens > float64(burst) {
+		bucket.tokens = float64(burst)
+	}
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		bucket.throttled = false
+		return true, false
+	}
+	started = !bucket.throttled
+	bucket.throttled = true
+	return false, started
+}
+
+// inputBatch collects server chat per server until it is posted.
+type inputBatch struct {
+	lines   map[string][]api.MessageWithSender
+	dropped map[string]int
+}
+
+func newInputBatch() *inputBatch {
+	return &inputBatch{
+		lines:   make(map[string][]api.MessageWithSender),
+		dropped: make(map[string]int),
+	}
+}
+
+// Add queues a line, dropping the server's oldest once it holds more than max.
+func (batch *inputBatch) Add(i api.MessageWithSender, max int) {
+	lines := append(batch.lines[i.Server], i)
+	if max > 0 && len(lines) > max {
+		batch.dropped[i.Server] += len(lines) - max
+		lines = lines[len(lines)-max:]
+	}
+	batch.lines[i.Server] = lines
+}
@@ -0,0 +1,60 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"io"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ISession is the subset of *discordgo.Session the DiscordHandler uses, so it can be faked in tests.
+type ISession interface {
+	Open() error
+	Close() error
+	UserID() string
+	AddHandler(handler interface{}) func()
+	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
+	ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error)
+	ChannelFileSend(channelID, name string, r io.Reader) (*discordgo.Message, error)
+	MessageReactionAdd(channelID, messageID, emojiID string) error
+	GuildMember(guildID, userID string) (*discordgo.Member, error)
+	GuildRoles(guildID string) ([]*discordgo.Role, error)
+}
+
+type discordSession struct {
+	*discordgo.Session
+}
+
+// NewSession wraps a discordgo session for the given bot token.
+func NewSession(token string) (ISession, error) {
+	session, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, err
+	}
+	return &discordSession{session}, nil
+}
+
+func (session *discordSession) UserID() string {
+	if session.State == nil || session.State.User == nil {
+		return ""
+	}
+	return session.State.User.ID
+}
+
+// GuildMember prefers the state cache, only asking Discord for members it has not seen.
+func (session *discordSession) GuildMember(guildID, userID string) (*discordgo.Member, error) {
+	if session.State != nil {
+		if member, err := session.State.Member(guildID, userID); err == nil {
+			return member, nil
+		}
+	}
+	return session.Session.GuildMember(guildID, userID)
+}
+
+func (session *discordSession) GuildRoles(guildID string) ([]*discordgo.Role, error) {
+	if session.State != nil {
+		if guild, err := session.State.Guild(guildID); err == nil {
+			return guild.Roles, nil
+		}
+	}
+	return session.Session.GuildRoles(guildID)
+}
@@ -0,0 +1,104 @@
+package discord // "github.com/itszuvalex/mcdiscord/pkg/discord"
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DiscordMessageLimit = 2000
+	// MinecraftChatLimit is the longest line sent in game, longer ones wrap badly or are rejected.
+	MinecraftChatLimit = 256
+	codeFence          = "```"
+)
+
+// SplitMessage breaks text into chunks of at most limit characters for Discord. It splits
+// at newlines where it can, then at spaces, and only cuts words that are longer than a
+// whole chunk. A code block that spans chunks is closed and reopened so each renders.
+func SplitMessage(text string, limit int) []string {
+	if utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+
+	var chunks []string
+	var chunk []string
+	length := 0
+	fence := ""
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		if fence != "" {
+			chunk = append(chunk, codeFence)
+		}
+		chunks = append(chunks, strings.Join(chunk, "\n"))
+		chunk = nil
+		length = 0
+		if fence != "" {
+			chunk = append(chunk, fence)
+			length = utf8.RuneCountInString(fence)
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		// Keep room for a closing fence if the chunk ends inside a code block.
+		room := limit - len(codeFence) - 1
+		for _, part := range wrapLine(line, room-utf8.RuneCountInString(fence)-1) {
+			size := utf8.RuneCountInString(part)
+			if length > 0 && length+1+size > room {
+				flush()
+			}
+			if length > 0 {
+				length++
+			}
+			chunk = append(chunk, part)
+			length += size
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+			if fence == "" {
+				fence = strings.TrimSpace(line)
+			} else {
+				fence = ""
+			}
+		}
+	}
+	fence = ""
+	flush()
+	return chunks
+}
+
+// SplitLines breaks text into lines of at most limit characters for Minecraft, which
+// cannot show newlines. Code fences are dropped since they only mean something in Discord.
+func SplitLines(text string, limit int) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+			continue
+		}
+		lines = append(lines, wrapLine(line, limit)...)
+	}
+	return lines
+}
+
+// wrapLine splits a single line at spaces so no part is longer than limit, cutting
+// words only when they do not fit on a line by themselves.
+func wrapLine(line string, limit int) []string {
+	if limit < 1 {
+		limit = 1
+	}
+	var parts []string
+	for utf8.RuneCountInString(line) > limit {
+		runes := []rune(line)
+		cut := limit
+		for i := limit; i > 0; i-- {
+			if runes[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		parts = append(parts, strings.TrimRight(string(runes[:cut]), " "))
+		line = strings.TrimLeft(string(runes[cut:]), " ")
+	}
+	return append(parts, line)
+}
@@ -0,0 +1,211 @@
+package history // "github.com/itszuvalex/mcdiscord/pkg/history"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	FileName    = "history.db"
+	OpenTimeout = 2 * time.Second
+	// Retention is how long chat is kept.
+	Retention = 30 * 24 * time.Hour
+	// pruneInterval is how often old chat is removed.
+	pruneInterval = time.Hour
+)
+
+var (
+	chatBucket = []byte("chat")
+	metaBucket = []byte("meta")
+	// adoptedKey is set once records name servers by ID.
+	adoptedKey = []byte("serverIds")
+)
+
+var _ api.IChatHistory = (*Store)(nil)
+
+// Store keeps chat in a bolt database, keyed by time so queries can walk back from the newest.
+type Store struct {
+	db        *bolt.DB
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func Open(file string) (*Store, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(chatBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (store *Store) Close() error {
+	return store.db.Close()
+}
+
+func (store *Store) Add(record api.ChatRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	store.mutex.Lock()
+	prune := now.Sub(store.lastPrune) >= pruneInterval
+	if prune {
+		store.lastPrune = now
+	}
+	store.mutex.Unlock()
+
+	// Batch shares one sync between the lines relayed at about the same time.
+	return store.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(chatBucket)
+		if prune {
+			cursor := bucket.Cursor()
+			oldest := make([]byte, 8)
+			binary.BigEndian.PutUint64(oldest, uint64(now.Add(-Retention).UnixNano()))
+			for key, _ := cursor.First(); key != nil && bytes.Compare(key[:8], oldest) < 0; key, _ = cursor.First() {
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		// The sequence keeps records from the same instant apart and in order.
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(record.Time.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		return bucket.Put(key, data)
+	})
+}
+
+func (store *Store) Query(query api.ChatQuery) ([]api.ChatRecord, error) {
+	var records []api.ChatRecord
+	since := make([]byte, 8)
+	if !query.Since.IsZero() {
+		binary.BigEndian.PutUint64(since, uint64(query.Since.UnixNano()))
+	}
+	text := strings.ToLower(query.Text)
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(chatBucket).Cursor()
+		for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+			if bytes.Compare(key[:8], since) < 0 {
+				break
+			}
+			var record api.ChatRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if !matches(query, text, record) {
+				continue
+			}
+			records = append(records, record)
+			if query.Limit > 0 && len(records) >= query.Limit {
+				break
+			}
+		}
+		return nil
+	})
+
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, err
+}
+
+// AdoptServerIds rewrites the server names of records made before servers had IDs. It only
+// runs once, records made since name servers by ID already.
+func (store *Store) AdoptServerIds(ids map[string]string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta.Get(adoptedKey) != nil {
+			return nil
+		}
+		bucket := tx.Bucket(chatBucket)
+		rewritten := make(map[string][]byte)
+		err := bucket.ForEach(func(key, value []byte) error {
+			var record api.ChatRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			changed := false
+			for i, server := range record.Servers {
+				if id, ok := ids[server]; ok {
+					record.Servers[i], changed = id, true
+				}
+			}
+			if !changed {
+				return nil
+			}
+			data, err := json.Marshal(&record)
+			rewritten[string(key)] = data
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// Puts wait until ForEach is done, a bucket must not change under its cursor.
+		for key, data := range rewritten {
+			if err = bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return meta.Put(adoptedKey, []byte{1})
+	})
+}
+
+func matches(query api.ChatQuery, text string, record api.ChatRecord) bool {
+	if query.Server != "" && !contains(record.Servers, query.Server) {
+		return false
+	}
+	if query.Player != "" && !strings.EqualFold(query.Player, record.Player) && !strings.EqualFold(query.Player, record.DiscordUser) {
+		return false
+	}
+	if text != "" && !strings.Contains(strings.ToLower(record.Message), text) {
+		return false
+	}
+	return query.Filter == nil || query.Filter(record)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseChat splits an in-game chat line such as "<Steve> hello" into player and message.
+// Lines that are not player chat come back with no player.
+func ParseChat(line string) (string, string) {
+	if strings.HasPrefix(line, "<") {
+		if end := strings.Index(line, "> "); end > 1 {
+			return line[1:end], line[end+2:]
+		}
+	}
+	return "", line
+}
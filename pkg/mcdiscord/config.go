@@ -1,25 +1,54 @@
 package mcdiscord // "github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/itszuvalex/mcdiscord/pkg/api"
 )
 
+const (
+	DefaultConfigBackups = 5
+)
+
 type configFile struct {
-	File          string
-	ReadHandlers  map[string]api.ConfigReadHandler
-	WriteHandlers map[string]api.ConfigWriteHandler
+	File             string
+	Backups          int
+	ReadHandlers     map[string]api.ConfigReadHandler
+	WriteHandlers    map[string]api.ConfigWriteHandler
+	ValidateHandlers map[string]api.ConfigValidateHandler
+	ConfigOptions    map[string]api.ConfigOption
+	Layers           []ConfigLayer
+	// unknown holds keys from the file that no handler claimed, so they survive a rewrite.
+	unknown map[string]json.RawMessage
+	// base holds the defaults and file values the layers were applied to, overrides the values
+	// the layers changed by dotted path. Overridden values are kept out of the file.
+	base      map[string]json.RawMessage
+	overrides map[string]json.RawMessage
+	version   int
+	modTime   time.Time
+	mutex     sync.Mutex
 }
 
-func NewConfig(file string) api.IConfig {
+// NewConfig creates a config backed by file. Layers are applied in order on top of
+// the handlers' defaults and the file contents every time the config is read.
+func NewConfig(file string, layers ...ConfigLayer) api.IConfig {
 	return &configFile{
-		File:          file,
-		ReadHandlers:  make(map[string]api.ConfigReadHandler),
-		WriteHandlers: make(map[string]api.ConfigWriteHandler),
+		File:             file,
+		Backups:          DefaultConfigBackups,
+		ReadHandlers:     make(map[string]api.ConfigReadHandler),
+		WriteHandlers:    make(map[string]api.ConfigWriteHandler),
+		ValidateHandlers: make(map[string]api.ConfigValidateHandler),
+		ConfigOptions:    make(map[string]api.ConfigOption),
+		Layers:           layers,
+		unknown:          make(map[string]json.RawMessage),
+		version:          ConfigVersion,
 	}
 }
 
@@ -31,27 +60,82 @@ func (cfile *configFile) AddWriteHandler(key string, handler api.ConfigWriteHand
 	cfile.WriteHandlers[key] = handler
 }
 
-func (cfile *configFile) Read() error {
-	_, err := os.Stat(cfile.File)
-	if os.IsNotExist(err) {
-		return nil
+func (cfile *configFile) AddValidateHandler(key string, handler api.ConfigValidateHandler) {
+	cfile.ValidateHandlers[key] = handler
+}
+
+func (cfile *configFile) AddOption(option api.ConfigOption) {
+	cfile.ConfigOptions[option.Path] = option
+}
+
+func (cfile *configFile) Option(path string) (api.ConfigOption, bool) {
+	option, ok := cfile.ConfigOptions[path]
+	return option, ok
+}
+
+func (cfile *configFile) Options() []api.ConfigOption {
+	options := make([]api.ConfigOption, 0, len(cfile.ConfigOptions))
+	for _, option := range cfile.ConfigOptions {
+		options = append(options, option)
 	}
+	sort.Slice(options, func(i, j int) bool { return options[i].Path < options[j].Path })
+	return options
+}
 
-	file, err := os.Open(cfile.File)
+func (cfile *configFile) Read() error {
+	cfile.mutex.Lock()
+	defer cfile.mutex.Unlock()
+	return cfile.read()
+}
+
+func (cfile *configFile) read() error {
+	cfile.modTime = fileModTime(cfile.File)
+	innerFields, err := ReadConfigFile(cfile.File)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	data, err := ioutil.ReadAll(file)
+	fileVersion, err := migrateConfig(innerFields)
 	if err != nil {
 		return err
 	}
+	cfile.version = ConfigVersion
+	if fileVersion > ConfigVersion {
+		fmt.Println("Config version", fileVersion, "is newer than this build supports,", ConfigVersion)
+		cfile.version = fileVersion
+	}
 
-	var innerFields map[string]json.RawMessage
-	err = json.Unmarshal(data, &innerFields)
-	if err != nil {
-		return err
+	cfile.unknown = make(map[string]json.RawMessage)
+	for key, value := range innerFields {
+		if _, ok := cfile.ReadHandlers[key]; !ok {
+			fmt.Println("Preserving unknown config key:", key)
+			cfile.unknown[key] = value
+		}
+	}
+
+	if len(cfile.Layers) > 0 {
+		// Start from the file view, so values from a previous read's layers don't become file values.
+		defaults, err := cfile.snapshot()
+		if err != nil {
+			return err
+		}
+		base := make(map[string]json.RawMessage, len(defaults))
+		for key, value := range innerFields {
+			defaults[key] = mergeConfig(defaults[key], value)
+		}
+		for key, value := range defaults {
+			base[key] = value
+		}
+		innerFields = defaults
+		for _, layer := range cfile.Layers {
+			if err = layer(innerFields); err != nil {
+				return err
+			}
+		}
+		cfile.base, cfile.overrides = base, layerOverrides(base, innerFields)
+	}
+	if len(cfile.Layers) == 0 {
+		cfile.base, cfile.overrides = nil, nil
 	}
 
 	for key := range innerFields {
@@ -63,32 +147,224 @@ func (cfile *configFile) Read() error {
 		}
 	}
 
+	if len(innerFields) > 0 && fileVersion < ConfigVersion {
+		fmt.Println("Migrated config from version", fileVersion, "to", ConfigVersion)
+		return cfile.write()
+	}
 	return nil
 }
 
+// Write validates every key, then atomically replaces the file, keeping the previous
+// versions as numbered backups. Nothing is written if any key fails.
 func (cfile *configFile) Write() error {
-	file, err := os.Create(cfile.File)
+	cfile.mutex.Lock()
+	defer cfile.mutex.Unlock()
+	return cfile.write()
+}
+
+func (cfile *configFile) write() error {
+	innerFields, err := cfile.snapshot()
+	if err != nil {
+		return err
+	}
+	if err = cfile.validate(innerFields); err != nil {
+		return err
+	}
+	for key, value := range cfile.unknown {
+		if _, ok := innerFields[key]; !ok {
+			innerFields[key] = value
+		}
+	}
+	innerFields[VersionKey], _ = json.Marshal(cfile.version)
+	data, err := json.Marshal(innerFields)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(cfile.File, data, cfile.Backups)
+	cfile.modTime = fileModTime(cfile.File)
+	return err
+}
+
+// Reload re-reads the file, rejecting it without touching the live config if any key
+// fails to parse or validate.
+func (cfile *configFile) Reload() error {
+	cfile.mutex.Lock()
+	defer cfile.mutex.Unlock()
+
+	innerFields, err := ReadConfigFile(cfile.File)
+	if err != nil {
+		cfile.modTime = fileModTime(cfile.File)
+		return fmt.Errorf("Rejected config reload, %v", err)
+	}
+	if _, err = migrateConfig(innerFields); err != nil {
+		cfile.modTime = fileModTime(cfile.File)
+		return fmt.Errorf("Rejected config reload, %v", err)
+	}
+	if err = cfile.validate(innerFields); err != nil {
+		cfile.modTime = fileModTime(cfile.File)
+		return fmt.Errorf("Rejected config reload, %v", err)
+	}
+	fmt.Println("Reloading config from", cfile.File)
+	return cfile.read()
+}
+
+// Watch reloads the config whenever the file changes on disk, checking every interval until ctx is done.
+func (cfile *configFile) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cfile.mutex.Lock()
+			changed := !fileModTime(cfile.File).Equal(cfile.modTime)
+			cfile.mutex.Unlock()
+			if !changed {
+				continue
+			}
+			if err := cfile.Reload(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+func fileModTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (cfile *configFile) validate(innerFields map[string]json.RawMessage) error {
+	for key, data := range innerFields {
+		if handler, ok := cfile.ValidateHandlers[key]; ok {
+			if err := handler(data); err != nil {
+				return fmt.Errorf("Invalid config json:%s, %v", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Restore replaces the config with backup n (1 is the most recent) and reads it back in.
+func (cfile *configFile) Restore(n int) error {
+	cfile.mutex.Lock()
+	defer cfile.mutex.Unlock()
+
+	innerFields, err := ReadConfigFile(backupName(cfile.File, n))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if len(innerFields) == 0 {
+		return fmt.Errorf("Config backup %d does not exist", n)
+	}
+	if err = cfile.validate(innerFields); err != nil {
+		return err
+	}
+	data, err := json.Marshal(innerFields)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(cfile.File, data, cfile.Backups); err != nil {
+		return err
+	}
+	return cfile.read()
+}
 
+// current collects the live value of every key from the write handlers, layers included.
+func (cfile *configFile) current() (map[string]json.RawMessage, error) {
 	innerFields := make(map[string]json.RawMessage)
 	for key := range cfile.WriteHandlers {
 		json, err := cfile.WriteHandlers[key]()
 		if err != nil {
-			fmt.Println("Error when writing json:"+key+",", err)
+			return nil, err
 		}
 		innerFields[key] = json
 	}
-	data, err := json.Marshal(innerFields)
+	return innerFields, nil
+}
+
+// snapshot collects every key as it belongs in the file. Values a layer overrides are put
+// back to what the file had, unless they have been changed since the layers applied them.
+func (cfile *configFile) snapshot() (map[string]json.RawMessage, error) {
+	innerFields, err := cfile.current()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	for path, value := range cfile.overrides {
+		live, err := GetConfigPath(innerFields, path)
+		if err != nil || !sameConfigValue(live, value) {
+			continue
+		}
+		if original, err := GetConfigPath(cfile.base, path); err == nil {
+			err = SetConfigPath(innerFields, path, original)
+		} else {
+			err = deleteConfigPath(innerFields, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return innerFields, nil
+}
+
+// Get returns the value in effect, including layer overrides.
+func (cfile *configFile) Get(path string) (json.RawMessage, error) {
+	cfile.mutex.Lock()
+	defer cfile.mutex.Unlock()
+
+	innerFields, err := cfile.current()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range cfile.unknown {
+		if _, ok := innerFields[key]; !ok {
+			innerFields[key] = value
+		}
 	}
-	_, err = file.Write(data)
+	return GetConfigPath(innerFields, path)
+}
+
+// Set changes a dotted path, applies it through the key's read handler and writes the file.
+func (cfile *configFile) Set(path string, value json.RawMessage) error {
+	cfile.mutex.Lock()
+	defer cfile.mutex.Unlock()
+
+	innerFields, err := cfile.snapshot()
 	if err != nil {
 		return err
 	}
+	key := strings.Split(path, ".")[0]
+	handler, ok := cfile.ReadHandlers[key]
+	if !ok {
+		return fmt.Errorf("No config handler registered for key %s", key)
+	}
+	if err = SetConfigPath(innerFields, path, value); err != nil {
+		return err
+	}
+	if err = cfile.validate(map[string]json.RawMessage{key: innerFields[key]}); err != nil {
+		return err
+	}
 
-	return nil
+	// The edit replaces whatever a layer set at or below path, other overrides stay in effect.
+	for override := range cfile.overrides {
+		if override == path || strings.HasPrefix(override, path+".") {
+			delete(cfile.overrides, override)
+		}
+	}
+	live := map[string]json.RawMessage{key: innerFields[key]}
+	for override, value := range cfile.overrides {
+		if strings.HasPrefix(override, key+".") {
+			if err = SetConfigPath(live, override, value); err != nil {
+				return err
+			}
+		}
+	}
+	if err = handler(live[key]); err != nil {
+		return err
+	}
+	return cfile.write()
 }
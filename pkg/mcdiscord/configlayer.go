@@ -0,0 +1,140 @@
+package mcdiscord // "github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	EnvPrefix = "MCDISCORD_"
+)
+
+// ConfigLayer overrides values in the config's top level fields before they reach the read handlers.
+type ConfigLayer func(fields map[string]json.RawMessage) error
+
+// EnvLayer maps variables such as MCDISCORD_DISCORD_CHANNELID to the path discord.channelId.
+// Path segments are matched case-insensitively against the known config keys.
+func EnvLayer(prefix string, environ []string) ConfigLayer {
+	return func(fields map[string]json.RawMessage) error {
+		for _, env := range environ {
+			split := strings.Index(env, "=")
+			if split < 0 || !strings.HasPrefix(env, prefix) {
+				continue
+			}
+			segments := strings.Split(env[len(prefix):split], "_")
+			// Other variables share the prefix, e.g. the token, only config keys are applied.
+			if path := resolveConfigPath(fields, segments); !hasConfigKey(fields, path) {
+				continue
+			}
+			if err := setLayerValue(fields, segments, env[split+1:]); err != nil {
+				fmt.Println("Ignoring "+env[:split]+",", err)
+			}
+		}
+		return nil
+	}
+}
+
+// FlagLayer applies "path=value" overrides, e.g. from repeated -set flags.
+func FlagLayer(values []string) ConfigLayer {
+	return func(fields map[string]json.RawMessage) error {
+		for _, value := range values {
+			split := strings.Index(value, "=")
+			if split < 0 {
+				return fmt.Errorf("Config override %s is not path=value", value)
+			}
+			segments := strings.Split(value[:split], ".")
+			if err := setLayerValue(fields, segments, value[split+1:]); err != nil {
+				return fmt.Errorf("Error applying %s, %v", value[:split], err)
+			}
+		}
+		return nil
+	}
+}
+
+func setLayerValue(fields map[string]json.RawMessage, segments []string, value string) error {
+	path := resolveConfigPath(fields, segments)
+	// Keep string fields strings even if the value looks like a number, e.g. channel ids.
+	if existing, err := GetConfigPath(fields, path); err == nil && strings.HasPrefix(string(existing), "\"") {
+		data, _ := json.Marshal(value)
+		return SetConfigPath(fields, path, data)
+	}
+	return SetConfigPath(fields, path, ParseConfigValue(value))
+}
+
+// resolveConfigPath finds the dotted path whose keys match segments ignoring case.
+func resolveConfigPath(fields map[string]json.RawMessage, segments []string) string {
+	var keys []string
+	current := fields
+	for _, segment := range segments {
+		key := strings.ToLower(segment)
+		for existing := range current {
+			if strings.EqualFold(existing, segment) {
+				key = existing
+				break
+			}
+		}
+		keys = append(keys, key)
+
+		var inner map[string]json.RawMessage
+		if current != nil {
+			json.Unmarshal(current[key], &inner)
+		}
+		current = inner
+	}
+	return strings.Join(keys, ".")
+}
+
+func hasConfigKey(fields map[string]json.RawMessage, path string) bool {
+	_, ok := fields[strings.Split(path, ".")[0]]
+	return ok
+}
+
+// layerOverrides lists the values layered differs from base in, by dotted path, descending
+// into objects so an override of one field does not claim its siblings.
+func layerOverrides(base map[string]json.RawMessage, layered map[string]json.RawMessage) map[string]json.RawMessage {
+	overrides := make(map[string]json.RawMessage)
+	for key, value := range layered {
+		diffConfig(key, base[key], value, overrides)
+	}
+	return overrides
+}
+
+func diffConfig(path string, base json.RawMessage, over json.RawMessage, overrides map[string]json.RawMessage) {
+	var baseFields, overFields map[string]json.RawMessage
+	if json.Unmarshal(base, &baseFields) == nil && json.Unmarshal(over, &overFields) == nil && baseFields != nil && overFields != nil {
+		for key, value := range overFields {
+			diffConfig(path+"."+key, baseFields[key], value, overrides)
+		}
+		return
+	}
+	if !sameConfigValue(base, over) {
+		overrides[path] = over
+	}
+}
+
+// sameConfigValue compares JSON values regardless of formatting and key order.
+func sameConfigValue(a json.RawMessage, b json.RawMessage) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// mergeConfig overlays one JSON value on another, merging objects key by key.
+func mergeConfig(base json.RawMessage, over json.RawMessage) json.RawMessage {
+	var baseFields, overFields map[string]json.RawMessage
+	if json.Unmarshal(base, &baseFields) != nil || json.Unmarshal(over, &overFields) != nil || baseFields == nil || overFields == nil {
+		return over
+	}
+	for key, value := range overFields {
+		baseFields[key] = mergeConfig(baseFields[key], value)
+	}
+	data, err := json.Marshal(baseFields)
+	if err != nil {
+		return over
+	}
+	return data
+}
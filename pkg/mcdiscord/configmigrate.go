@@ -0,0 +1,98 @@
+package mcdiscord // "github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/server"
+)
+
+const (
+	VersionKey = "version"
+)
+
+// ConfigMigration reshapes a config's top level fields from one version to the next.
+type ConfigMigration func(fields map[string]json.RawMessage) error
+
+// configMigrations[i] upgrades a version i config to version i+1. Append to this
+// list whenever the on-disk layout changes, never edit an existing entry.
+//
+// The single discord.channelId of configs from before per-guild settings has no
+// migration: which guild the channel is in is only known once Discord sends a message
+// from it, so the discord handler moves it into that guild then.
+var configMigrations = []ConfigMigration{
+	migrateUnversioned,
+	migrateServerIds,
+}
+
+// ConfigVersion is the layout written by this build.
+var ConfigVersion = len(configMigrations)
+
+// migrateConfig removes the version key from fields and applies every migration
+// needed to bring them up to ConfigVersion, returning the version that was read.
+func migrateConfig(fields map[string]json.RawMessage) (int, error) {
+	version := 0
+	if data, ok := fields[VersionKey]; ok {
+		if err := json.Unmarshal(data, &version); err != nil {
+			return 0, fmt.Errorf("Invalid config version, %v", err)
+		}
+		delete(fields, VersionKey)
+	}
+	if len(fields) == 0 {
+		return ConfigVersion, nil
+	}
+
+	for v := version; v < len(configMigrations); v++ {
+		if err := configMigrations[v](fields); err != nil {
+			return version, fmt.Errorf("Error migrating config from version %d, %v", v, err)
+		}
+	}
+	return version, nil
+}
+
+// migrateUnversioned handles configs written before versioning, which only ever
+// held a "discord" section. Their layout is still current, they just gain a version.
+func migrateUnversioned(fields map[string]json.RawMessage) error {
+	return nil
+}
+
+// migrateServerIds gives every server listed without an id the ID it has been running
+// under, derived from its location, so stored data keyed by that ID stays with it.
+func migrateServerIds(fields map[string]json.RawMessage) error {
+	data, ok := fields[server.ConfigKey]
+	if !ok {
+		return nil
+	}
+	var section map[string]json.RawMessage
+	if err := json.Unmarshal(data, &section); err != nil {
+		return err
+	}
+	var servers []map[string]json.RawMessage
+	if list, ok := section["servers"]; !ok {
+		return nil
+	} else if err := json.Unmarshal(list, &servers); err != nil {
+		return err
+	}
+	for _, entry := range servers {
+		if id, ok := entry["id"]; ok && string(id) != `""` {
+			continue
+		}
+		var location api.NetLocation
+		if err := json.Unmarshal(entry["location"], &location); err != nil {
+			return err
+		}
+		id, err := json.Marshal(server.LocationServerId(location))
+		if err != nil {
+			return err
+		}
+		entry["id"] = id
+	}
+	list, err := json.Marshal(servers)
+	if err != nil {
+		return err
+	}
+	section["servers"] = list
+	fields[server.ConfigKey], err = json.Marshal(section)
+	return err
+}
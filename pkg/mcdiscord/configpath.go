@@ -0,0 +1,211 @@
+package mcdiscord // "github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	mydisc "github.com/itszuvalex/mcdiscord/pkg/discord"
+	"github.com/itszuvalex/mcdiscord/pkg/server"
+)
+
+// GetConfigPath looks up a dotted path such as "discord.channelId" in a config's top level fields.
+func GetConfigPath(fields map[string]json.RawMessage, path string) (json.RawMessage, error) {
+	keys := strings.Split(path, ".")
+	value, ok := fields[keys[0]]
+	if !ok {
+		return nil, fmt.Errorf("Config key %s not found", keys[0])
+	}
+	for i, key := range keys[1:] {
+		var inner map[string]json.RawMessage
+		if err := json.Unmarshal(value, &inner); err != nil {
+			return nil, fmt.Errorf("Config key %s is not an object", strings.Join(keys[:i+1], "."))
+		}
+		value, ok = inner[key]
+		if !ok {
+			return nil, fmt.Errorf("Config key %s not found", strings.Join(keys[:i+2], "."))
+		}
+	}
+	return value, nil
+}
+
+// SetConfigPath sets a dotted path in a config's top level fields, creating objects along the way.
+func SetConfigPath(fields map[string]json.RawMessage, path string, value json.RawMessage) error {
+	keys := strings.Split(path, ".")
+	if len(keys) == 1 {
+		fields[keys[0]] = value
+		return nil
+	}
+
+	inner := make(map[string]json.RawMessage)
+	if existing, ok := fields[keys[0]]; ok && string(existing) != "null" {
+		if err := json.Unmarshal(existing, &inner); err != nil {
+			return fmt.Errorf("Config key %s is not an object", keys[0])
+		}
+	}
+	if err := SetConfigPath(inner, strings.Join(keys[1:], "."), value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(inner)
+	if err != nil {
+		return err
+	}
+	fields[keys[0]] = data
+	return nil
+}
+
+// deleteConfigPath removes a dotted path from a config's top level fields, if it is there.
+func deleteConfigPath(fields map[string]json.RawMessage, path string) error {
+	keys := strings.Split(path, ".")
+	if len(keys) == 1 {
+		delete(fields, keys[0])
+		return nil
+	}
+	existing, ok := fields[keys[0]]
+	if !ok {
+		return nil
+	}
+	var inner map[string]json.RawMessage
+	if err := json.Unmarshal(existing, &inner); err != nil || inner == nil {
+		return nil
+	}
+	if err := deleteConfigPath(inner, strings.Join(keys[1:], ".")); err != nil {
+		return err
+	}
+	data, err := json.Marshal(inner)
+	if err != nil {
+		return err
+	}
+	fields[keys[0]] = data
+	return nil
+}
+
+// ParseConfigValue accepts JSON, falling back to treating value as a plain string.
+func ParseConfigValue(value string) json.RawMessage {
+	if json.Valid([]byte(value)) {
+		return json.RawMessage(value)
+	}
+	data, _ := json.Marshal(value)
+	return data
+}
+
+// SetOfflineConfigPath sets a dotted path in a config's top level fields, parsing and
+// checking value as the running bot's config set would. It is used by the command line
+// when editing the file offline.
+func SetOfflineConfigPath(fields map[string]json.RawMessage, path string, value string) error {
+	key := strings.Split(path, ".")[0]
+	validators := map[string]api.ConfigValidateHandler{
+		mydisc.ConfigKey: mydisc.ValidateConfig,
+		server.ConfigKey: server.ValidateConfig,
+	}
+	validate, ok := validators[key]
+	if !ok {
+		return fmt.Errorf("No config handler registered for key %s", key)
+	}
+	data := ParseConfigValue(value)
+	for _, option := range append(mydisc.ConfigOptions(), server.ConfigOptions()...) {
+		if option.Path == path {
+			var err error
+			if data, err = option.Parse(value); err != nil {
+				return err
+			}
+		}
+	}
+	if err := SetConfigPath(fields, path, data); err != nil {
+		return err
+	}
+	if err := validate(fields[key]); err != nil {
+		return fmt.Errorf("Invalid config json:%s, %v", key, err)
+	}
+	return nil
+}
+
+// ReadConfigFile reads the raw top level fields of a config file without any handlers.
+func ReadConfigFile(file string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return fields, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// WriteConfigFile writes raw top level fields to a config file, keeping backups of the old one.
+func WriteConfigFile(file string, fields map[string]json.RawMessage) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data, DefaultConfigBackups)
+}
+
+// RestoreConfigFile replaces a config file with backup n without any handlers.
+func RestoreConfigFile(file string, n int) error {
+	fields, err := ReadConfigFile(backupName(file, n))
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("Config backup %d does not exist", n)
+	}
+	return WriteConfigFile(file, fields)
+}
+
+func backupName(file string, n int) string {
+	return fmt.Sprintf("%s.%d", file, n)
+}
+
+// writeFileAtomic writes data to a temporary file next to file and renames it into
+// place, so a crash mid-write never leaves a truncated file. The previous contents
+// are rotated into file.1 through file.backups.
+func writeFileAtomic(file string, data []byte, backups int) error {
+	temp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		if _, err := os.Stat(file); err == nil {
+			for i := backups - 1; i >= 1; i-- {
+				if _, err := os.Stat(backupName(file, i)); err == nil {
+					os.Rename(backupName(file, i), backupName(file, i+1))
+				}
+			}
+			if err = copyFile(file, backupName(file, 1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
@@ -0,0 +1,183 @@
+package mcdiscord // "github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/control"
+)
+
+// HandleControl serves requests from the command line over the control socket.
+func (discord *McDiscord) HandleControl(request control.Request) control.Response {
+	var output string
+	var err error
+	switch request.Command {
+	case "servers":
+		output, err = discord.controlServers(request.Args)
+	case "config":
+		output, err = discord.controlConfig(request.Args)
+	case "send":
+		output, err = discord.controlSend(request.Args)
+	default:
+		err = fmt.Errorf("Unknown command: %s", request.Command)
+	}
+	discord.auditControl(request, err)
+	if err != nil {
+		return control.Response{Output: output, Error: err.Error()}
+	}
+	return control.Response{Output: output}
+}
+
+// auditControl logs requests that change something, send is audited as a console command.
+func (discord *McDiscord) auditControl(request control.Request, err error) {
+	if request.Command == "send" || len(request.Args) == 0 || request.Args[0] == "list" || request.Args[0] == "get" {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	entry := api.AuditEntry{User: "control", Command: request.Command, Args: strings.Join(request.Args, " "), Result: result}
+	if err := discord.Audit.Append(entry); err != nil {
+		fmt.Println("Error writing audit log,", err)
+	}
+}
+
+func (discord *McDiscord) controlServers(args []string) (string, error) {
+	if len(args) < 1 {
+		return "", errors.New("servers needs list|add|rename|move|tag|remove")
+	}
+	switch args[0] {
+	case "list":
+		var lines []string
+		for loc, server := range discord.Servers.Servers() {
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%s\t%s", server.Name(), loc, server.Status(), strings.Join(server.Tags(), ",")))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n"), nil
+	case "add":
+		if len(args) < 3 {
+			return "", errors.New("servers add needs {host[:port]} {name}")
+		}
+		location, err := discord.Servers.ResolveLocation(args[1])
+		if err != nil {
+			return "", err
+		}
+		return "", discord.Servers.AddServer(*location, strings.Join(args[2:], " "))
+	case "rename":
+		if len(args) < 3 {
+			return "", errors.New("servers rename needs {name} {new name}")
+		}
+		return "", discord.Servers.RenameServer(args[1], strings.Join(args[2:], " "))
+	case "move":
+		if len(args) < 3 {
+			return "", errors.New("servers move needs {name} {host[:port]}")
+		}
+		location, err := discord.Servers.ResolveLocation(args[len(args)-1])
+		if err != nil {
+			return "", err
+		}
+		return "", discord.Servers.MoveServer(strings.Join(args[1:len(args)-1], " "), *location)
+	case "tag":
+		if len(args) < 2 {
+			return "", errors.New("servers tag needs {name} [tag...]")
+		}
+		return "", discord.Servers.SetServerTags(args[1], args[2:])
+	case "remove":
+		if len(args) < 2 {
+			return "", errors.New("servers remove needs {name} or {host:port}")
+		}
+		target := strings.Join(args[1:], " ")
+		if strings.Contains(target, ":") {
+			location, err := api.ParseNetLocation(target)
+			if err != nil {
+				return "", err
+			}
+			return "", discord.Servers.RemoveServer(*location)
+		}
+		return "", discord.Servers.RemoveServerByName(target)
+	}
+	return "", fmt.Errorf("Unknown servers command: %s", args[0])
+}
+
+func (discord *McDiscord) controlConfig(args []string) (string, error) {
+	if len(args) >= 1 && args[0] == "restore" {
+		n, err := api.ParseBackup(args[1:])
+		if err != nil {
+			return "", err
+		}
+		return "", discord.Config.Restore(n)
+	}
+	if len(args) < 2 {
+		return "", errors.New("config needs get {path}, set {path} {value} or restore [n]")
+	}
+	switch args[0] {
+	case "get":
+		value, err := discord.Config.Get(args[1])
+		if err != nil {
+			return "", err
+		}
+		return string(value), nil
+	case "set":
+		if len(args) < 3 {
+			return "", errors.New("config set needs {path} {value}")
+		}
+		value := strings.Join(args[2:], " ")
+		if option, ok := discord.Config.Option(args[1]); ok {
+			data, err := option.Parse(value)
+			if err != nil {
+				return "", err
+			}
+			return "", discord.Config.Set(args[1], data)
+		}
+		return "", discord.Config.Set(args[1], ParseConfigValue(value))
+	}
+	return "", fmt.Errorf("Unknown config command: %s", args[0])
+}
+
+func (discord *McDiscord) controlSend(args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("send needs {server|group:<tag>} {message}")
+	}
+	var server api.IServer
+	if !strings.HasPrefix(args[0], api.GroupPrefix) {
+		if server = FindServer(discord.Servers, args[0]); server == nil {
+			return "", fmt.Errorf("Could not find a server of name %s", args[0])
+		}
+	}
+
+	command := api.Command{Command: fmt.Sprintf("say %s", api.SayText(strings.Join(args[1:], " "))), Source: "control"}
+	var header api.Header
+	if err := api.MarshalCommandToHeader(&command, &header); err != nil {
+		return "", err
+	}
+	discord.auditCommand(api.CommandAudit{Time: time.Now(), Command: command.Command, Source: command.Source, Allowed: true})
+	if server == nil {
+		summary := discord.Servers.SendPacketToServers(header, args[:1])
+		if len(summary.Results) == 0 {
+			return "", fmt.Errorf("No servers in %s", args[0])
+		}
+		return fmt.Sprintf("%d of %d delivered", summary.Count(api.Delivered), len(summary.Results)), nil
+	}
+	status, err := server.Send(header)
+	return status.String(), err
+}
+
+// FindServer looks a server up by name or by host:port. Names come first, a bare name is
+// also a valid host.
+func FindServer(handler api.IServerHandler, target string) api.IServer {
+	servers := handler.Servers()
+	for _, server := range servers {
+		if server.Name() == target {
+			return server
+		}
+	}
+	if location, err := api.ParseNetLocation(target); err == nil {
+		return servers[*location]
+	}
+	return nil
+}
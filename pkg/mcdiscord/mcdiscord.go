@@ -1,53 +1,186 @@
 package mcdiscord // "github.com/itszuvalex/mcdiscord/pkg/mcdiscord"
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/audit"
 	mydisc "github.com/itszuvalex/mcdiscord/pkg/discord"
+	"github.com/itszuvalex/mcdiscord/pkg/history"
+	"github.com/itszuvalex/mcdiscord/pkg/metrics"
 	"github.com/itszuvalex/mcdiscord/pkg/server"
+	"github.com/itszuvalex/mcdiscord/pkg/sessions"
 )
 
 type McDiscord struct {
-	Discord api.IDiscordHandler
-	Servers api.IServerHandler
-	Config  api.IConfig
+	Discord  api.IDiscordHandler
+	Servers  api.IServerHandler
+	Config   api.IConfig
+	Audit    api.IAuditLog
+	History  api.IChatHistory
+	Sessions api.IPlayerSessions
+	Metrics  api.IStatusHistory
+	// WatchInterval is how often the config file is checked for changes, 0 disables watching.
+	WatchInterval time.Duration
 }
 
-func New(token string, configFile string) (*McDiscord, error) {
+// New creates the bot, reading configFile with layers applied on top of it.
+func New(token string, configFile string, layers ...ConfigLayer) (*McDiscord, error) {
 	discord := new(McDiscord)
-	discord.Config = NewConfig(configFile)
+	discord.Config = NewConfig(configFile, layers...)
 	discordhandler, err := mydisc.NewDiscordHandler(token, discord.Config)
 	if err != nil {
 		fmt.Println("Error creating Discord Handler session, ", err)
 		return nil, err
 	}
 	discord.Discord = discordhandler
+	discord.Audit = audit.NewLog(filepath.Join(filepath.Dir(configFile), audit.FileName))
+	discord.Discord.SetAuditLog(discord.Audit)
+	discord.Discord.SetCommandAudit(discord.auditCommand)
+	discord.History, err = history.Open(filepath.Join(filepath.Dir(configFile), history.FileName))
+	if err != nil {
+		fmt.Println("Error opening chat history,", err)
+		return nil, err
+	}
+	discord.Discord.SetChatHistory(discord.History)
+	discord.Sessions, err = sessions.Open(filepath.Join(filepath.Dir(configFile), sessions.FileName))
+	if err != nil {
+		fmt.Println("Error opening player sessions,", err)
+		discord.History.Close()
+		return nil, err
+	}
+	discord.Discord.SetPlayerSessions(discord.Sessions)
+	discord.Metrics, err = metrics.Open(filepath.Join(filepath.Dir(configFile), metrics.FileName))
+	if err != nil {
+		fmt.Println("Error opening status history,", err)
+		discord.History.Close()
+		discord.Sessions.Close()
+		return nil, err
+	}
+	discord.Discord.SetStatusHistory(discord.Metrics)
 	discord.Servers = server.NewServerHandler(discord.Config, discord.Discord)
 	discord.Discord.SetServerHandler(discord.Servers)
+	discord.Servers.AddStatusHandler(discord.trackPlayers)
+	discord.Servers.AddStatusHandler(discord.sampleStatus)
+	discord.Servers.AddRenameHandler(discord.Discord.RenameServer)
+	discord.Servers.AddStatusHandler(discord.Discord.CheckAlerts)
 
 	err = discord.Config.Read()
 	if err != nil {
 		fmt.Println("Error reading Config,", err)
+		discord.History.Close()
+		discord.Sessions.Close()
+		discord.Metrics.Close()
 		return nil, err
 	}
+	discord.adoptServerIds()
 
 	return discord, nil
 }
 
-func (discord *McDiscord) Open() error {
-	return discord.Discord.Open()
+// auditCommand prints every console command sent or refused, and logs those that did not
+// come from a Discord command, which is audited as a whole. Relayed chat is logged as chat.
+func (discord *McDiscord) auditCommand(entry api.CommandAudit) {
+	printAudit(entry)
+	if strings.HasPrefix(entry.Source, mydisc.DiscordSource) {
+		return
+	}
+	kind := "console"
+	if strings.HasPrefix(entry.Source, mydisc.ChatSource) {
+		kind = "chat"
+	}
+	result := "ok"
+	if !entry.Allowed {
+		result = entry.Reason
+	}
+	err := discord.Audit.Append(api.AuditEntry{Time: entry.Time, User: entry.Source, Command: kind, Args: entry.Command, Result: result})
+	if err != nil {
+		fmt.Println("Error writing audit log,", err)
+	}
+}
+
+func (discord *McDiscord) trackPlayers(server api.IServer, status api.McServerData) {
+	if err := discord.Sessions.Update(server.Id(), status.Players, time.Now()); err != nil {
+		fmt.Println("Error tracking players,", err)
+	}
+}
+
+func (discord *McDiscord) sampleStatus(server api.IServer, status api.McServerData) {
+	if err := discord.Metrics.Add(server.Id(), status, time.Now()); err != nil {
+		fmt.Println("Error storing status history,", err)
+	}
+}
+
+// adoptServerIds moves data stored by server name, from before servers had IDs, to the IDs
+// of the configured servers. Data is kept by ID so it follows a server through renames.
+func (discord *McDiscord) adoptServerIds() {
+	ids := make(map[string]string)
+	for _, server := range discord.Servers.Servers() {
+		ids[server.Name()] = server.Id()
+	}
+	if err := discord.History.AdoptServerIds(ids); err != nil {
+		fmt.Println("Error moving chat history to server IDs,", err)
+	}
+	if err := discord.Sessions.AdoptServerIds(ids); err != nil {
+		fmt.Println("Error moving player sessions to server IDs,", err)
+	}
+	if err := discord.Metrics.AdoptServerIds(ids); err != nil {
+		fmt.Println("Error moving status history to server IDs,", err)
+	}
+}
+
+func printAudit(entry api.CommandAudit) {
+	if entry.Allowed {
+		fmt.Println("Audit:", entry.Source, "ran", entry.Command)
+	} else {
+		fmt.Println("Audit:", entry.Source, "was refused", entry.Command+",", entry.Reason)
+	}
+}
+
+func (discord *McDiscord) Open(ctx context.Context) error {
+	err := discord.Discord.Open(ctx)
+	if err != nil {
+		return err
+	}
+	if discord.WatchInterval > 0 {
+		go discord.Config.Watch(ctx, discord.WatchInterval)
+	}
+	return discord.Servers.Open(ctx)
 }
 
-func (discord *McDiscord) Close() []error {
+// Close shuts down Discord first so pending chat is flushed to the servers, tells the
+// servers the bot is going offline, then closes them. Everything is bounded by ctx.
+func (discord *McDiscord) Close(ctx context.Context) []error {
 	var errors []error
-	err := discord.Discord.Close()
+	err := discord.Discord.Close(ctx)
 	if err != nil {
 		errors = append(errors, err)
 	}
-	servErrors := discord.Servers.Close()
+
+	message := api.Message{Timestamp: time.Now().Format(time.Stamp), Message: api.OfflineNotice}
+	var header api.Header
+	if err = api.MarshallMessageToHeader(&message, &header); err == nil {
+		discord.Servers.SendPacketToAllServers(header)
+	}
+
+	servErrors := discord.Servers.Close(ctx)
 	if servErrors != nil {
 		errors = append(errors, servErrors...)
 	}
+
+	// Servers may still deliver chat until they are closed.
+	if err = discord.History.Close(); err != nil {
+		errors = append(errors, err)
+	}
+	if err = discord.Sessions.Close(); err != nil {
+		errors = append(errors, err)
+	}
+	if err = discord.Metrics.Close(); err != nil {
+		errors = append(errors, err)
+	}
 	return errors
 }
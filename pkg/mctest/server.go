@@ -0,0 +1,344 @@
+package mctest // "github.com/itszuvalex/mcdiscord/pkg/mctest"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	DefaultStatusInterval = 5 * time.Second
+	DefaultTps            = 20.0
+	DefaultMemoryMax      = 4096
+	DefaultPlayerMax      = 20
+)
+
+// Server is a scriptable fake of the Minecraft mod's websocket endpoint.
+// It keeps a list of simulated players, pushes periodic McServerData status,
+// answers commands with canned results and can inject faults.
+type Server struct {
+	Name           string
+	StatusInterval time.Duration
+
+	listener  net.Listener
+	server    http.Server
+	conns     map[*websocket.Conn]bool
+	players   []string
+	tps       map[int]float32
+	memory    int
+	commands  map[string]string
+	received  []api.Header
+	readDelay time.Duration
+	refuse    bool
+	stopchan  chan bool
+	closeOnce sync.Once
+	mutex     sync.Mutex
+}
+
+// NewServer creates a fake server listening on port, 0 picks a free port.
+func NewServer(port int) (*Server, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Name:           "mctest",
+		StatusInterval: DefaultStatusInterval,
+		listener:       listener,
+		conns:          make(map[*websocket.Conn]bool),
+		tps:            map[int]float32{0: DefaultTps},
+		memory:         DefaultMemoryMax / 4,
+		commands:       make(map[string]string),
+		stopchan:       make(chan bool),
+	}, nil
+}
+
+// Location returns the address the bot should connect to.
+func (server *Server) Location() api.NetLocation {
+	addr := server.listener.Addr().(*net.TCPAddr)
+	return api.NetLocation{Address: addr.IP.String(), Port: addr.Port}
+}
+
+func (server *Server) Start() error {
+	mux := http.NewServeMux()
+	mux.Handle("/", websocket.Handler(server.handle))
+	server.server = http.Server{Handler: mux}
+	go server.server.Serve(server.listener)
+	if server.StatusInterval > 0 {
+		go server.statusLoop()
+	}
+	return nil
+}
+
+func (server *Server) Close() error {
+	server.closeOnce.Do(func() { close(server.stopchan) })
+	server.Disconnect()
+	return server.server.Close()
+}
+
+// Connections returns the number of currently connected clients.
+func (server *Server) Connections() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.conns)
+}
+
+// Players returns a sorted snapshot of the simulated players.
+func (server *Server) Players() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	players := append([]string(nil), server.players...)
+	sort.Strings(players)
+	return players
+}
+
+// Received returns a snapshot of every header the bot has sent.
+func (server *Server) Received() []api.Header {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]api.Header(nil), server.received...)
+}
+
+// Commands returns every command the bot has sent, in order.
+func (server *Server) Commands() []string {
+	var commands []string
+	for _, header := range server.Received() {
+		if header.Type != api.CommandType {
+			continue
+		}
+		var command api.Command
+		if err := json.Unmarshal(header.Data, &command); err == nil {
+			commands = append(commands, command.Command)
+		}
+	}
+	return commands
+}
+
+// Join adds a player and announces it in chat.
+func (server *Server) Join(player string) error {
+	server.mutex.Lock()
+	server.players = append(server.players, player)
+	server.mutex.Unlock()
+	return server.Broadcast(fmt.Sprintf("%s joined the game", player))
+}
+
+// Leave removes a player and announces it in chat.
+func (server *Server) Leave(player string) error {
+	server.mutex.Lock()
+	for i, p := range server.players {
+		if p == player {
+			server.players = append(server.players[:i], server.players[i+1:]...)
+			break
+		}
+	}
+	server.mutex.Unlock()
+	return server.Broadcast(fmt.Sprintf("%s left the game", player))
+}
+
+// Chat sends a chat line from player.
+func (server *Server) Chat(player string, text string) error {
+	return server.Broadcast(fmt.Sprintf("<%s> %s", player, text))
+}
+
+// SetTps sets the reported tps for a dimension.
+func (server *Server) SetTps(dimension int, tps float32) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.tps[dimension] = tps
+}
+
+// SetMemory sets the reported memory usage.
+func (server *Server) SetMemory(memory int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.memory = memory
+}
+
+// HandleCommand registers a canned result for commands starting with prefix.
+// The result is sent back to the bot as a chat message.
+func (server *Server) HandleCommand(prefix string, result string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.commands[prefix] = result
+}
+
+// SetReadDelay slows down every read from the bot by delay.
+func (server *Server) SetReadDelay(delay time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.readDelay = delay
+}
+
+// RefuseConnections makes the server drop new connections immediately.
+func (server *Server) RefuseConnections(refuse bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.refuse = refuse
+}
+
+// Disconnect drops every connected client.
+func (server *Server) Disconnect() {
+	server.mutex.Lock()
+	conns := server.conns
+	server.conns = make(map[*websocket.Conn]bool)
+	server.mutex.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// SendMalformed sends data that is not a valid Header to every client.
+func (server *Server) SendMalformed(data string) error {
+	return server.each(func(conn *websocket.Conn) error {
+		return websocket.Message.Send(conn, data)
+	})
+}
+
+// Broadcast sends a chat message to every client.
+func (server *Server) Broadcast(text string) error {
+	message := api.Message{Timestamp: time.Now().Format(time.Stamp), Message: text}
+	var header api.Header
+	if err := api.MarshallMessageToHeader(&message, &header); err != nil {
+		return err
+	}
+	return server.Send(header)
+}
+
+// SendStatus pushes the current McServerData to every client.
+func (server *Server) SendStatus() error {
+	var header api.Header
+	if err := api.MarshalStatusToHeader(server.Status(), &header); err != nil {
+		return err
+	}
+	return server.Send(header)
+}
+
+// Status builds the McServerData the server would currently report.
+func (server *Server) Status() *api.McServerData {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	tps := make(map[int]float32, len(server.tps))
+	for dim, value := range server.tps {
+		tps[dim] = value
+	}
+	return &api.McServerData{
+		Memory:      server.memory,
+		MemoryMax:   DefaultMemoryMax,
+		Players:     append([]string(nil), server.players...),
+		PlayerCount: len(server.players),
+		PlayerMax:   DefaultPlayerMax,
+		Tps:         tps,
+		Name:        server.Name,
+		Status:      "running",
+	}
+}
+
+// Send writes header to every client.
+func (server *Server) Send(header api.Header) error {
+	return server.each(func(conn *websocket.Conn) error {
+		return websocket.JSON.Send(conn, &header)
+	})
+}
+
+func (server *Server) each(send func(conn *websocket.Conn) error) error {
+	server.mutex.Lock()
+	conns := make([]*websocket.Conn, 0, len(server.conns))
+	for conn := range server.conns {
+		conns = append(conns, conn)
+	}
+	server.mutex.Unlock()
+
+	var firstErr error
+	for _, conn := range conns {
+		if err := send(conn); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (server *Server) statusLoop() {
+	ticker := time.NewTicker(server.StatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.stopchan:
+			return
+		case <-ticker.C:
+			server.SendStatus()
+		}
+	}
+}
+
+func (server *Server) handle(ws *websocket.Conn) {
+	server.mutex.Lock()
+	if server.refuse {
+		server.mutex.Unlock()
+		ws.Close()
+		return
+	}
+	server.conns[ws] = true
+	server.mutex.Unlock()
+
+	defer func() {
+		server.mutex.Lock()
+		delete(server.conns, ws)
+		server.mutex.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		server.mutex.Lock()
+		delay := server.readDelay
+		server.mutex.Unlock()
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		var header api.Header
+		if err := websocket.JSON.Receive(ws, &header); err != nil {
+			return
+		}
+		server.mutex.Lock()
+		server.received = append(server.received, header)
+		server.mutex.Unlock()
+
+		if header.Type == api.CommandType {
+			server.runCommand(ws, header)
+		}
+	}
+}
+
+func (server *Server) runCommand(ws *websocket.Conn, header api.Header) {
+	var command api.Command
+	if err := json.Unmarshal(header.Data, &command); err != nil {
+		return
+	}
+
+	server.mutex.Lock()
+	result, ok := "", false
+	longest := -1
+	for prefix, canned := range server.commands {
+		if strings.HasPrefix(command.Command, prefix) && len(prefix) > longest {
+			result, ok, longest = canned, true, len(prefix)
+		}
+	}
+	server.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	message := api.Message{Timestamp: time.Now().Format(time.Stamp), Message: result}
+	var reply api.Header
+	if err := api.MarshallMessageToHeader(&message, &reply); err == nil {
+		websocket.JSON.Send(ws, &reply)
+	}
+}
@@ -0,0 +1,152 @@
+package metrics // "github.com/itszuvalex/mcdiscord/pkg/metrics"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	FileName    = "metrics.db"
+	OpenTimeout = 2 * time.Second
+	// SampleInterval is the least time between two samples of a server, statuses in
+	// between are dropped.
+	SampleInterval = time.Minute
+	// Retention is how long samples are kept.
+	Retention = 30 * 24 * time.Hour
+	// pruneInterval is how often a server's old samples are removed.
+	pruneInterval = time.Hour
+)
+
+var _ api.IStatusHistory = (*Store)(nil)
+
+// Store keeps status samples in a bolt database, one bucket per server ID keyed by time.
+type Store struct {
+	db         *bolt.DB
+	lastSample map[string]time.Time
+	lastPrune  map[string]time.Time
+	mutex      sync.Mutex
+}
+
+func Open(file string) (*Store, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		db:         db,
+		lastSample: make(map[string]time.Time),
+		lastPrune:  make(map[string]time.Time),
+	}, nil
+}
+
+func (store *Store) Close() error {
+	return store.db.Close()
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// Add stores a sample of status, unless server was sampled less than SampleInterval ago.
+func (store *Store) Add(server string, status api.McServerData, now time.Time) error {
+	store.mutex.Lock()
+	if now.Sub(store.lastSample[server]) < SampleInterval {
+		store.mutex.Unlock()
+		return nil
+	}
+	store.lastSample[server] = now
+	prune := now.Sub(store.lastPrune[server]) >= pruneInterval
+	if prune {
+		store.lastPrune[server] = now
+	}
+	store.mutex.Unlock()
+
+	players := status.PlayerCount
+	if players == 0 {
+		players = len(status.Players)
+	}
+	data, err := json.Marshal(&api.StatusSample{
+		Time:      now,
+		Tps:       status.Tps,
+		Players:   players,
+		Memory:    status.Memory,
+		MemoryMax: status.MemoryMax,
+	})
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(server))
+		if err != nil {
+			return err
+		}
+		if prune {
+			cursor := bucket.Cursor()
+			oldest := timeKey(now.Add(-Retention))
+			for key, _ := cursor.First(); key != nil && string(key) < string(oldest); key, _ = cursor.First() {
+				if err = cursor.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return bucket.Put(timeKey(now), data)
+	})
+}
+
+// AdoptServerIds moves samples from buckets named after servers, from before servers had
+// IDs, into the buckets of their IDs.
+func (store *Store) AdoptServerIds(ids map[string]string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		for name, id := range ids {
+			old := tx.Bucket([]byte(name))
+			if old == nil || name == id {
+				continue
+			}
+			bucket, err := tx.CreateBucketIfNotExists([]byte(id))
+			if err != nil {
+				return err
+			}
+			err = old.ForEach(func(key, value []byte) error {
+				return bucket.Put(key, value)
+			})
+			if err != nil {
+				return err
+			}
+			if err = tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *Store) Query(server string, since time.Time) ([]api.StatusSample, error) {
+	var samples []api.StatusSample
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(server))
+		if bucket == nil {
+			return nil
+		}
+		from := make([]byte, 8)
+		if !since.IsZero() {
+			from = timeKey(since)
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.Seek(from); key != nil; key, value = cursor.Next() {
+			var sample api.StatusSample
+			if err := json.Unmarshal(value, &sample); err != nil {
+				return err
+			}
+			samples = append(samples, sample)
+		}
+		return nil
+	})
+	return samples, err
+}
@@ -1,8 +1,11 @@
 package server // "github.com/itszuvalex/mcdiscord/pkg/server"
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,24 +15,40 @@ import (
 
 const (
 	ConsecutiveErrorMax = 5
+	DeliveryTimeout     = 2 * time.Second
+	FlushPollInterval   = 100 * time.Millisecond
 )
 
+// ReconnectDelay is how long a server waits between connection attempts, tests shorten it.
+var ReconnectDelay = 15 * time.Second
+
 type mcServerNet struct {
 	Location    api.NetLocation
 	Origin      string
 	Conn        *websocket.Conn
 	JsonHandler *api.JsonHandler
-	JsonChan    chan api.Header
-	stopchan    chan bool
+	Outbox      *outbox
 	Status      api.ConnectionStatus
 	errcount    int
 	mutex       sync.Mutex
+	// ctx spans the server's lifetime, connCancel only the current connection.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	connCancel context.CancelFunc
+	wg         sync.WaitGroup
 }
 
 type mcServer struct {
-	net  mcServerNet
-	data api.McServerData
-	name string
+	net       mcServerNet
+	data      api.McServerData
+	dataMutex sync.RWMutex
+	id        string
+	name      string
+	tags      []string
+}
+
+func (mcs *mcServer) Id() string {
+	return mcs.id
 }
 
 func (mcs *mcServer) Location() api.NetLocation {
@@ -37,34 +56,95 @@ func (mcs *mcServer) Location() api.NetLocation {
 }
 
 func (mcs *mcServer) Name() string {
+	mcs.dataMutex.RLock()
+	defer mcs.dataMutex.RUnlock()
 	return mcs.name
 }
 
-func (mcs *mcServer) StartConnectLoop() error {
-	return mcs.net.StartConnectLoop()
+func (mcs *mcServer) SetName(name string) {
+	mcs.dataMutex.Lock()
+	defer mcs.dataMutex.Unlock()
+	mcs.name = name
+}
+
+func (mcs *mcServer) Data() api.McServerData {
+	mcs.dataMutex.RLock()
+	defer mcs.dataMutex.RUnlock()
+	return mcs.data
+}
+
+// Tags returns the groups the server belongs to.
+func (mcs *mcServer) Tags() []string {
+	mcs.dataMutex.RLock()
+	defer mcs.dataMutex.RUnlock()
+	return mcs.tags
+}
+
+func (mcs *mcServer) SetTags(tags []string) {
+	mcs.dataMutex.Lock()
+	defer mcs.dataMutex.Unlock()
+	mcs.tags = append([]string(nil), tags...)
+}
+
+func (mcs *mcServer) Status() api.ConnectionStatus {
+	mcs.net.mutex.Lock()
+	defer mcs.net.mutex.Unlock()
+	return mcs.net.Status
+}
+
+func (mcs *mcServer) StartConnectLoop(ctx context.Context) error {
+	return mcs.net.StartConnectLoop(ctx)
+}
+
+func (mcs *mcServer) Close(ctx context.Context) error {
+	return mcs.net.Close(ctx)
 }
 
-func (mcs *mcServer) Close() error {
-	return mcs.net.Close()
+// Send queues header for delivery, it is sent immediately if the server is connected
+// and replayed in order once it reconnects otherwise.
+func (mcs *mcServer) Send(header api.Header) (api.DeliveryStatus, error) {
+	pending, err := mcs.Queue(header)
+	if err != nil {
+		return api.Dropped, err
+	}
+	if status := pending(); status != api.Dropped {
+		return status, nil
+	}
+	return api.Dropped, fmt.Errorf("Outbox of server %s overflowed, dropped packet", mcs.net.Location)
 }
 
-func (mcs *mcServer) JsonChan() chan api.Header {
-	return mcs.net.JsonChan
+// Queue pushes header to the outbox, the returned PendingDelivery waits up to DeliveryTimeout
+// for it if the server is connected.
+func (mcs *mcServer) Queue(header api.Header) (api.PendingDelivery, error) {
+	entry, ok := mcs.net.Outbox.Push(header)
+	if !ok {
+		return nil, fmt.Errorf("Outbox full for server %s, dropped packet", mcs.net.Location)
+	}
+	connected := mcs.net.IsConnected()
+	return func() api.DeliveryStatus {
+		if !connected {
+			return api.Queued
+		}
+		return entry.wait(DeliveryTimeout)
+	}, nil
 }
 
-func NewMcServer(location api.NetLocation, origin string, name string, msgchan chan api.MessageWithSender) api.IServer {
+func NewMcServer(location api.NetLocation, origin string, id string, name string, outboxconfig OutboxConfig, msgchan chan api.MessageWithSender, statushandler api.StatusHandler) api.IServer {
 	server := &mcServer{
 		mcServerNet{
 			Location:    location,
 			Origin:      origin,
 			Conn:        nil,
 			JsonHandler: api.NewJsonHandler(),
-			JsonChan:    make(chan api.Header, 40),
-			stopchan:    make(chan bool, 2),
+			Outbox:      newOutbox(outboxconfig, id, location),
 			Status:      api.Disconnected,
+			ctx:         context.Background(),
 		},
 		api.McServerData{Name: name},
+		sync.RWMutex{},
+		id,
 		name,
+		nil,
 	}
 	server.net.JsonHandler.RegisterHandler(api.MessageType, func(obj interface{}) error {
 		message, ok := obj.(*api.Message)
@@ -75,7 +155,10 @@ func NewMcServer(location api.NetLocation, origin string, name string, msgchan c
 
 		fmt.Println(message.Timestamp, "  :", message.Message)
 
-		msgchan <- api.MessageWithSender{Sender: "", Message: message.Message}
+		select {
+		case msgchan <- api.MessageWithSender{Sender: "", Message: message.Message, Server: server.Name(), ServerId: server.Id()}:
+		case <-server.net.Done():
+		}
 
 		return nil
 	})
@@ -86,24 +169,43 @@ func NewMcServer(location api.NetLocation, origin string, name string, msgchan c
 			return errors.New("MessageHandler passed non *McServerData obj")
 		}
 
-		fmt.Println(message)
+		server.dataMutex.Lock()
+		server.data = *message
+		server.dataMutex.Unlock()
+		if statushandler != nil {
+			statushandler(server, *message)
+		}
 		return nil
 	})
 
 	return server
 }
 
-func (server *mcServerNet) StartConnectLoop() error {
+// StartConnectLoop keeps trying to connect to the server until it succeeds or ctx is done.
+func (server *mcServerNet) StartConnectLoop(ctx context.Context) error {
+	server.mutex.Lock()
+	server.ctx, server.cancel = context.WithCancel(ctx)
+	server.mutex.Unlock()
+	return server.startConnectLoop()
+}
+
+func (server *mcServerNet) startConnectLoop() error {
 	server.mutex.Lock()
 	defer server.mutex.Unlock()
 	if server.Status != api.Disconnected {
 		return nil
 	}
+	if err := server.ctx.Err(); err != nil {
+		return err
+	}
 
-	fmt.Println(fmt.Sprintf("Starting to connect to server %s:%d", server.Location.Address, server.Location.Port))
+	fmt.Println(fmt.Sprintf("Starting to connect to server %s", server.Location))
 	server.Status = api.Connecting
 
+	ctx := server.ctx
+	server.wg.Add(1)
 	go func() {
+		defer server.wg.Done()
 		for {
 			server.mutex.Lock()
 			status := server.Status
@@ -118,26 +220,44 @@ func (server *mcServerNet) StartConnectLoop() error {
 				break
 			}
 
-			timer := time.NewTimer(15 * time.Second)
-			<-timer.C
+			timer := time.NewTimer(ReconnectDelay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
 		}
 	}()
 
 	return nil
 }
 
+func (server *mcServerNet) IsConnected() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.Status == api.Connected
+}
+
+// Done is closed once the server has been closed.
+func (server *mcServerNet) Done() <-chan struct{} {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.ctx.Done()
+}
+
 func (server *mcServerNet) HandleError(err error) error {
 
 	if err != nil {
-		fmt.Println(fmt.Sprintf("Encountered error on server %s:%d, ", server.Location.Address, server.Location.Port), err)
+		fmt.Println(fmt.Sprintf("Encountered error on server %s, ", server.Location), err)
 		server.mutex.Lock()
 		server.errcount++
 		errCount := server.errcount
 		server.mutex.Unlock()
 		if errCount > ConsecutiveErrorMax {
-			fmt.Println(fmt.Sprintf("Too many errors encountered, closing and restarting connection to server %s:%d", server.Location.Address, server.Location.Port))
-			server.Close()
-			server.StartConnectLoop()
+			fmt.Println(fmt.Sprintf("Too many errors encountered, closing and restarting connection to server %s", server.Location))
+			server.disconnect()
+			server.startConnectLoop()
 		}
 	} else {
 		server.mutex.Lock()
@@ -148,60 +268,143 @@ func (server *mcServerNet) HandleError(err error) error {
 }
 
 func (server *mcServerNet) Connect() error {
-	var err error
-	server.Conn, err = websocket.Dial(fmt.Sprintf("ws://%s:%d", server.Location.Address, server.Location.Port), "", fmt.Sprintf("http://%s", server.Origin))
+	conn, err := websocket.Dial("ws://"+server.Location.String(), "", originURL(server.Origin))
 	if err != nil {
 		fmt.Println("Error connecting to server, ", err)
 		return err
 	}
 
-	fmt.Println("Successfully connected to server")
 	server.mutex.Lock()
+	if err = server.ctx.Err(); err != nil {
+		server.mutex.Unlock()
+		conn.Close()
+		return err
+	}
+	connCtx, connCancel := context.WithCancel(server.ctx)
+	server.Conn = conn
+	server.connCancel = connCancel
 	server.Status = api.Connected
+	server.wg.Add(2)
 	server.mutex.Unlock()
+	fmt.Println("Successfully connected to server")
 
-	go server.handleMessages()
-	go server.handleInput()
+	go server.handleMessages(connCtx, conn)
 
 	t := time.Now()
 	message := api.Message{Timestamp: t.Format(time.Stamp), Message: "Discord Bot: Successfully connected to server."}
 	var header api.Header
 	api.MarshallMessageToHeader(&message, &header)
-	server.HandleError(websocket.JSON.Send(server.Conn, &header))
+	server.HandleError(websocket.JSON.Send(conn, &header))
 
 	fmt.Println("Successfully sent bytes to server")
 
+	if pending := server.Outbox.Len(); pending > 0 {
+		fmt.Println(fmt.Sprintf("Replaying %d queued packets to server %s", pending, server.Location))
+	}
+	go server.handleInput(connCtx, conn)
+
 	return nil
 }
 
-func (server *mcServerNet) Close() error {
+// originURL makes the websocket origin of a configured host, which may also be a full URL.
+func originURL(origin string) string {
+	if strings.Contains(origin, "://") {
+		return origin
+	}
+	if origin == "" {
+		origin = "localhost"
+	}
+	if ip := net.ParseIP(origin); ip != nil && ip.To4() == nil {
+		origin = "[" + origin + "]"
+	}
+	return "http://" + origin
+}
+
+// disconnect drops the current connection without waiting for its goroutines.
+func (server *mcServerNet) disconnect() error {
+	server.mutex.Lock()
 	server.Status = api.Disconnected
 	server.errcount = 0
-	server.stopchan <- true
-	server.stopchan <- true
-	return server.Conn.Close()
+	conn := server.Conn
+	server.Conn = nil
+	if server.connCancel != nil {
+		server.connCancel()
+		server.connCancel = nil
+	}
+	server.mutex.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
 }
 
-func (server *mcServerNet) handleMessages() {
+// Close flushes the outbox while connected, then disconnects and waits for every
+// goroutine belonging to the server to exit or ctx to expire.
+func (server *mcServerNet) Close(ctx context.Context) error {
+	if server.IsConnected() {
+		ticker := time.NewTicker(FlushPollInterval)
+	flush:
+		for server.Outbox.Len() > 0 {
+			select {
+			case <-ctx.Done():
+				break flush
+			case <-ticker.C:
+			}
+		}
+		ticker.Stop()
+	}
+
+	server.mutex.Lock()
+	if server.cancel != nil {
+		server.cancel()
+	}
+	server.mutex.Unlock()
+
+	err := server.disconnect()
+	if waitErr := api.WaitContext(ctx, &server.wg); waitErr != nil {
+		return fmt.Errorf("Timed out waiting for server %s to shut down, %v", server.Location, waitErr)
+	}
+	return err
+}
+
+func (server *mcServerNet) handleMessages(ctx context.Context, conn *websocket.Conn) {
+	defer server.wg.Done()
 	for {
-		select {
-		case <-server.stopchan:
+		var header api.Header
+		err := websocket.JSON.Receive(conn, &header)
+		if ctx.Err() != nil {
 			return
-		default:
-			var header api.Header
-			server.HandleError(websocket.JSON.Receive(server.Conn, &header))
-			server.JsonHandler.HandleJson(header)
 		}
+		if server.HandleError(err) != nil {
+			continue
+		}
+		server.JsonHandler.HandleJson(header)
 	}
 }
 
-func (server *mcServerNet) handleInput() {
+func (server *mcServerNet) handleInput(ctx context.Context, conn *websocket.Conn) {
+	defer server.wg.Done()
+	server.drainOutbox(conn)
 	for {
 		select {
-		case <-server.stopchan:
+		case <-ctx.Done():
+			return
+		case <-server.Outbox.Notify():
+			server.drainOutbox(conn)
+		}
+	}
+}
+
+// drainOutbox sends queued headers in order, leaving anything that fails to send for the next attempt.
+func (server *mcServerNet) drainOutbox(conn *websocket.Conn) {
+	for {
+		entry, ok := server.Outbox.Peek()
+		if !ok {
+			return
+		}
+		if server.HandleError(websocket.JSON.Send(conn, &entry.Header)) != nil {
 			return
-		case header := <-server.JsonChan:
-			server.HandleError(websocket.JSON.Send(server.Conn, &header))
 		}
+		server.Outbox.Pop(entry)
 	}
 }
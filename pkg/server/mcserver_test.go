@@ -0,0 +1,172 @@
+package server // "github.com/itszuvalex/mcdiscord/pkg/server"
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	"github.com/itszuvalex/mcdiscord/pkg/mctest"
+)
+
+const waitTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	ReconnectDelay = 50 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// eventually polls cond until it holds, failing the test if it does not within waitTimeout.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startFake(t *testing.T, port int) *mctest.Server {
+	t.Helper()
+	fake, err := mctest.NewServer(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.StatusInterval = 0
+	if err = fake.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func connectServer(t *testing.T, location api.NetLocation, msgchan chan api.MessageWithSender, statushandler api.StatusHandler) (api.IServer, context.CancelFunc) {
+	t.Helper()
+	server := NewMcServer(location, "localhost", NewServerId(), "survival", DefaultOutboxConfig(), msgchan, statushandler)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := server.StartConnectLoop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return server, cancel
+}
+
+func closeTestServer(t *testing.T, server api.IServer, cancel context.CancelFunc) {
+	t.Helper()
+	defer cancel()
+	ctx, done := context.WithTimeout(context.Background(), waitTimeout)
+	defer done()
+	if err := server.Close(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectAndRelay(t *testing.T) {
+	fake := startFake(t, 0)
+	defer fake.Close()
+	msgchan := make(chan api.MessageWithSender, 10)
+	statuses := make(chan api.McServerData, 10)
+	server, cancel := connectServer(t, fake.Location(), msgchan, func(server api.IServer, status api.McServerData) {
+		statuses <- status
+	})
+	defer closeTestServer(t, server, cancel)
+
+	eventually(t, "connect", func() bool { return server.Status() == api.Connected && fake.Connections() == 1 })
+
+	if err := fake.Chat("alice", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-msgchan:
+		if message.Message != "<alice> hello" || message.Server != "survival" {
+			t.Errorf("relayed %+v", message)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("Timed out waiting for chat")
+	}
+
+	fake.Join("bob")
+	<-msgchan
+	if err := fake.SendStatus(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case status := <-statuses:
+		if len(status.Players) != 1 || status.Players[0] != "bob" {
+			t.Errorf("status players %v", status.Players)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("Timed out waiting for status")
+	}
+	if players := server.Data().Players; len(players) != 1 {
+		t.Errorf("server data players %v", players)
+	}
+
+	var header api.Header
+	command := api.Command{Command: "say hi", Source: "test"}
+	if err := api.MarshalCommandToHeader(&command, &header); err != nil {
+		t.Fatal(err)
+	}
+	status, err := server.Send(header)
+	if err != nil || status != api.Delivered {
+		t.Fatalf("Send returned %s, %v", status, err)
+	}
+	eventually(t, "command", func() bool {
+		commands := fake.Commands()
+		return len(commands) == 1 && commands[0] == "say hi"
+	})
+}
+
+func TestReplayAfterReconnect(t *testing.T) {
+	fake := startFake(t, 0)
+	location := fake.Location()
+	msgchan := make(chan api.MessageWithSender, 10)
+	server, cancel := connectServer(t, location, msgchan, nil)
+	defer closeTestServer(t, server, cancel)
+	eventually(t, "connect", func() bool { return server.Status() == api.Connected })
+
+	// With the fake gone the server keeps retrying, what is sent meanwhile waits in the outbox.
+	fake.Close()
+	eventually(t, "disconnect", func() bool { return server.Status() != api.Connected })
+	sent := []string{"say one", "say two", "say three"}
+	for _, text := range sent {
+		var header api.Header
+		command := api.Command{Command: text, Source: "test"}
+		if err := api.MarshalCommandToHeader(&command, &header); err != nil {
+			t.Fatal(err)
+		}
+		if status, err := server.Send(header); err != nil || status != api.Queued {
+			t.Fatalf("Send while disconnected returned %s, %v", status, err)
+		}
+	}
+
+	fake = startFake(t, location.Port)
+	defer fake.Close()
+	eventually(t, "replay", func() bool { return len(fake.Commands()) == len(sent) })
+	for i, command := range fake.Commands() {
+		if command != sent[i] {
+			t.Errorf("command %d replayed as %q, want %q", i, command, sent[i])
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	fake := startFake(t, 0)
+	defer fake.Close()
+	server, cancel := connectServer(t, fake.Location(), make(chan api.MessageWithSender, 10), nil)
+	eventually(t, "connect", func() bool { return fake.Connections() == 1 })
+
+	closeTestServer(t, server, cancel)
+	if status := server.Status(); status != api.Disconnected {
+		t.Errorf("status after close is %s", status)
+	}
+	eventually(t, "the fake to see the close", func() bool { return fake.Connections() == 0 })
+	if _, err := server.Queue(api.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := fake.Connections(); n != 0 {
+		t.Errorf("%d connections after close", n)
+	}
+}
@@ -0,0 +1,230 @@
+package server // "github.com/itszuvalex/mcdiscord/pkg/server"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+const (
+	DropOldest string = "oldest"
+	DropNewest string = "newest"
+)
+
+// OutboxConfig controls how packets are held for a server that is not connected.
+type OutboxConfig struct {
+	Capacity   int    `json:"capacity"`
+	DropPolicy string `json:"dropPolicy"`
+	TtlSeconds int    `json:"ttlSeconds"`
+	Dir        string `json:"dir"`
+}
+
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		Capacity:   200,
+		DropPolicy: DropOldest,
+		TtlSeconds: 600,
+		Dir:        "",
+	}
+}
+
+type outboxEntry struct {
+	Header api.Header `json:"header"`
+	Queued time.Time  `json:"queued"`
+	// done is closed once the entry leaves the outbox, status then tells whether it was
+	// delivered or dropped.
+	done   chan struct{}
+	status api.DeliveryStatus
+}
+
+func newOutboxEntry(header api.Header, queued time.Time) *outboxEntry {
+	return &outboxEntry{Header: header, Queued: queued, done: make(chan struct{}), status: api.Queued}
+}
+
+// wait returns how the entry left the outbox, or Queued if it is still waiting after timeout.
+func (entry *outboxEntry) wait(timeout time.Duration) api.DeliveryStatus {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-entry.done:
+		return entry.status
+	case <-timer.C:
+		return api.Queued
+	}
+}
+
+// finish records how the entry left the outbox, it must be called with the outbox mutex held.
+func (entry *outboxEntry) finish(status api.DeliveryStatus) {
+	if entry.status != api.Queued {
+		return
+	}
+	entry.status = status
+	close(entry.done)
+}
+
+// outbox is a bounded FIFO of packets waiting to be delivered to a server.
+// If a directory is configured the queue is mirrored to disk so it survives restarts.
+type outbox struct {
+	config  OutboxConfig
+	file    string
+	entries []*outboxEntry
+	notify  chan struct{}
+	mutex   sync.Mutex
+}
+
+// newOutbox creates the outbox of server id. Outboxes used to be saved by location, such a
+// file is taken over if the server has none of its own yet.
+func newOutbox(config OutboxConfig, id string, location api.NetLocation) *outbox {
+	box := &outbox{
+		config: config,
+		notify: make(chan struct{}, 1),
+	}
+	if config.Dir != "" {
+		box.file = outboxFile(config, id)
+		legacy := filepath.Join(config.Dir, fmt.Sprintf("%s_%d.json", location.Address, location.Port))
+		if _, err := os.Stat(box.file); os.IsNotExist(err) {
+			if err = os.Rename(legacy, box.file); err != nil && !os.IsNotExist(err) {
+				fmt.Println("Error moving outbox file "+legacy+",", err)
+			}
+		}
+		if err := box.load(); err != nil {
+			fmt.Println("Error loading outbox file "+box.file+",", err)
+		}
+	}
+	return box
+}
+
+func outboxFile(config OutboxConfig, id string) string {
+	return filepath.Join(config.Dir, id+".json")
+}
+
+// removeOutboxFile deletes the saved outbox of a server that was removed.
+func removeOutboxFile(config OutboxConfig, id string) {
+	if config.Dir == "" {
+		return
+	}
+	if err := os.Remove(outboxFile(config, id)); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error removing outbox file,", err)
+	}
+}
+
+// Push queues a header, returning its entry, or false if the header was dropped. With
+// DropOldest a full outbox makes room by dropping its oldest entry, whose waiters are told.
+func (box *outbox) Push(header api.Header) (*outboxEntry, bool) {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+
+	box.expire()
+	if box.config.Capacity > 0 && len(box.entries) >= box.config.Capacity {
+		if box.config.DropPolicy == DropNewest {
+			return nil, false
+		}
+		fmt.Println("Outbox full, dropping oldest packet")
+		box.entries[0].finish(api.Dropped)
+		box.entries = box.entries[1:]
+	}
+	entry := newOutboxEntry(header, time.Now())
+	box.entries = append(box.entries, entry)
+	box.save()
+
+	select {
+	case box.notify <- struct{}{}:
+	default:
+	}
+	return entry, true
+}
+
+// Peek returns the oldest unexpired entry without removing it.
+func (box *outbox) Peek() (*outboxEntry, bool) {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+
+	box.expire()
+	if len(box.entries) == 0 {
+		return nil, false
+	}
+	return box.entries[0], true
+}
+
+// Pop removes entry from the front of the queue once it has been delivered.
+func (box *outbox) Pop(entry *outboxEntry) {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+
+	entry.finish(api.Delivered)
+	if len(box.entries) == 0 || box.entries[0] != entry {
+		return
+	}
+	box.entries = box.entries[1:]
+	box.save()
+}
+
+func (box *outbox) Len() int {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+	return len(box.entries)
+}
+
+func (box *outbox) Notify() chan struct{} {
+	return box.notify
+}
+
+func (box *outbox) expire() {
+	if box.config.TtlSeconds <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-time.Duration(box.config.TtlSeconds) * time.Second)
+	i := 0
+	for i < len(box.entries) && box.entries[i].Queued.Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		fmt.Println("Dropping", i, "expired packets from outbox")
+		for _, entry := range box.entries[:i] {
+			entry.finish(api.Dropped)
+		}
+		box.entries = box.entries[i:]
+		box.save()
+	}
+}
+
+func (box *outbox) load() error {
+	data, err := ioutil.ReadFile(box.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &box.entries); err != nil {
+		return err
+	}
+	for i, entry := range box.entries {
+		box.entries[i] = newOutboxEntry(entry.Header, entry.Queued)
+	}
+	return nil
+}
+
+func (box *outbox) save() {
+	if box.file == "" {
+		return
+	}
+	data, err := json.Marshal(box.entries)
+	if err != nil {
+		fmt.Println("Error marshalling outbox,", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(box.file), 0755); err != nil {
+		fmt.Println("Error creating outbox directory,", err)
+		return
+	}
+	if err = ioutil.WriteFile(box.file, data, 0644); err != nil {
+		fmt.Println("Error writing outbox file "+box.file+",", err)
+	}
+}
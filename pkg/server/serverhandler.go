@@ -1,93 +1,657 @@
 package server // "github.com/itszuvalex/mcdiscord/pkg/server"
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/itszuvalex/mcdiscord/pkg/api"
 )
 
+const (
+	ConfigKey     = "servers"
+	RemoveTimeout = 5 * time.Second
+)
+
+// ServerHandler owns the set of connected servers. It is safe for concurrent use,
+// accessors hand out snapshots rather than the live map.
 type ServerHandler struct {
-	ServerMap      map[api.NetLocation]api.IServer
+	serverMap      map[api.NetLocation]api.IServer
+	moving         map[string]moveReservation
+	config         ServerHandlerConfig
 	mainconfig     api.IConfig
 	discordhandler api.IDiscordHandler
+	statushandlers []api.StatusHandler
+	renamehandlers []api.RenameHandler
+	ctx            context.Context
+	mutex          sync.RWMutex
+}
+
+type ServerHandlerConfig struct {
+	Outbox OutboxConfig `json:"outbox"`
+	// Origin is the host sent as the websocket origin, empty guesses an address of this machine.
+	Origin string `json:"origin"`
+	// LookupSrv looks up a _minecraft._tcp SRV record for servers added without a port.
+	LookupSrv bool           `json:"lookupSrv"`
+	Servers   []ServerConfig `json:"servers"`
+}
+
+// moveReservation keeps the name and both addresses of a server being moved, by ID, while
+// it is out of serverMap.
+type moveReservation struct {
+	config ServerConfig
+	from   api.NetLocation
+}
+
+// ServerConfig is the persisted form of a single server.
+type ServerConfig struct {
+	// Id identifies the server through renames and moves.
+	Id       string          `json:"id"`
+	Name     string          `json:"name"`
+	Location api.NetLocation `json:"location"`
+	// Tags put the server in groups that commands can target as group:<tag>.
+	Tags []string `json:"tags,omitempty"`
 }
 
 func NewServerHandler(config api.IConfig, discordhandler api.IDiscordHandler) api.IServerHandler {
-	return &ServerHandler{
-		ServerMap:      make(map[api.NetLocation]api.IServer),
+	handler := &ServerHandler{
+		serverMap: make(map[api.NetLocation]api.IServer),
+		moving:    make(map[string]moveReservation),
+		config: ServerHandlerConfig{
+			Outbox: DefaultOutboxConfig(),
+		},
 		mainconfig:     config,
 		discordhandler: discordhandler,
 	}
+
+	handler.mainconfig.AddReadHandler(ConfigKey, handler.handleConfigRead)
+	handler.mainconfig.AddWriteHandler(ConfigKey, handler.handleConfigWrite)
+	handler.mainconfig.AddValidateHandler(ConfigKey, ValidateConfig)
+	for _, option := range ConfigOptions() {
+		handler.mainconfig.AddOption(option)
+	}
+
+	return handler
+}
+
+// ConfigOptions lists the servers values that can be changed with config set.
+func ConfigOptions() []api.ConfigOption {
+	defaults := DefaultOutboxConfig()
+	return []api.ConfigOption{
+		api.IntOption(ConfigKey+".outbox.capacity",
+			"Packets held per disconnected server.", defaults.Capacity, 0, 100000),
+		api.EnumOption(ConfigKey+".outbox.dropPolicy",
+			"Which packet to drop when the outbox is full.", defaults.DropPolicy, DropOldest, DropNewest),
+		api.IntOption(ConfigKey+".outbox.ttlSeconds",
+			"Seconds a queued packet is kept, 0 keeps it forever.", defaults.TtlSeconds, 0, 7*24*60*60),
+		api.StringOption(ConfigKey+".outbox.dir",
+			"Directory the outbox is saved to, empty keeps it in memory.", defaults.Dir, nil),
+		api.StringOption(ConfigKey+".origin",
+			"Host sent as the websocket origin to servers connected after the change, empty guesses a local address.", "", nil),
+		api.BoolOption(ConfigKey+".lookupSrv",
+			"Look up a _minecraft._tcp SRV record for servers added without a port.", false),
+	}
+}
+
+// ValidateConfig checks the servers section, it is also used by the command line when editing offline.
+func ValidateConfig(data json.RawMessage) error {
+	// Keys the file leaves out keep their defaults, as they do when the config is read.
+	config := ServerHandlerConfig{Outbox: DefaultOutboxConfig()}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	if config.Outbox.Capacity < 0 || config.Outbox.TtlSeconds < 0 {
+		return errors.New("outbox capacity and ttlSeconds must not be negative")
+	}
+	if config.Outbox.DropPolicy != DropOldest && config.Outbox.DropPolicy != DropNewest {
+		return fmt.Errorf("outbox dropPolicy must be %s or %s", DropOldest, DropNewest)
+	}
+	seen := make(map[api.NetLocation]bool)
+	names := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, server := range config.Servers {
+		if err := api.ValidateServerName(server.Name); err != nil {
+			return err
+		}
+		if names[server.Name] {
+			return fmt.Errorf("server name %s is used twice", server.Name)
+		}
+		names[server.Name] = true
+		if server.Id != "" && ids[server.Id] {
+			return fmt.Errorf("server id %s is used twice", server.Id)
+		}
+		ids[server.Id] = true
+		if server.Location.Address == "" {
+			return fmt.Errorf("server %s has no address", server.Name)
+		}
+		if server.Location.Port < 1 || server.Location.Port > 65535 {
+			return fmt.Errorf("server %s has invalid port %d", server.Name, server.Location.Port)
+		}
+		if seen[server.Location] {
+			return fmt.Errorf("server %s is listed twice", server.Location)
+		}
+		seen[server.Location] = true
+		for _, tag := range server.Tags {
+			if err := api.ValidateTag(tag); err != nil {
+				return fmt.Errorf("server %s: %v", server.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// NewServerId returns a random ID for a new server.
+func NewServerId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// LocationServerId is the ID given to a server configured without one, derived from its
+// location so it stays the same across restarts until the config is written.
+func LocationServerId(location api.NetLocation) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%d", location.Address, location.Port)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// handleConfigRead applies outbox settings and brings the running servers in line with
+// the configured list by ID, connecting new servers, closing ones that were removed and
+// renaming or moving the rest.
+func (handler *ServerHandler) handleConfigRead(data json.RawMessage) error {
+	handler.mutex.RLock()
+	config := ServerHandlerConfig{Outbox: handler.config.Outbox, Origin: handler.config.Origin, LookupSrv: handler.config.LookupSrv}
+	handler.mutex.RUnlock()
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	for i, server := range config.Servers {
+		if server.Id == "" {
+			config.Servers[i].Id = LocationServerId(server.Location)
+		}
+	}
+
+	var removed, moved []api.IServer
+	var renamed [][2]string
+	handler.mutex.Lock()
+	handler.config.Outbox = config.Outbox
+	handler.config.Origin = config.Origin
+	handler.config.LookupSrv = config.LookupSrv
+	if config.Servers != nil {
+		configured := make(map[string]ServerConfig, len(config.Servers))
+		for _, server := range config.Servers {
+			configured[server.Id] = server
+		}
+		for loc, server := range handler.serverMap {
+			wanted, ok := configured[server.Id()]
+			if !ok {
+				fmt.Println("Removing server no longer in config:", server.Name())
+				delete(handler.serverMap, loc)
+				removed = append(removed, server)
+				continue
+			}
+			if wanted.Location != loc {
+				delete(handler.serverMap, loc)
+				moved = append(moved, server)
+				continue
+			}
+			if wanted.Name != server.Name() {
+				renamed = append(renamed, [2]string{server.Name(), wanted.Name})
+				server.SetName(wanted.Name)
+			}
+		}
+	}
+	handler.mutex.Unlock()
+
+	// Moved servers are closed before they reconnect, so their outbox is saved first.
+	for _, server := range moved {
+		closeServer(server)
+	}
+	for _, server := range removed {
+		handler.removeServer(server)
+	}
+	handler.mutex.Lock()
+	for _, server := range config.Servers {
+		if existing, ok := handler.serverMap[server.Location]; ok && existing.Id() == server.Id {
+			existing.SetTags(server.Tags)
+			continue
+		}
+		// A server being moved is added back by the move.
+		if _, ok := handler.moving[server.Id]; ok {
+			continue
+		}
+		if err := handler.addServer(server); err != nil {
+			fmt.Println("Error adding configured server,", err)
+		}
+	}
+	handler.mutex.Unlock()
+
+	// Stored data follows a rename made in the file, settings naming the server are taken
+	// as the file has them.
+	for _, names := range renamed {
+		handler.renamed(names[0], names[1])
+	}
+	return nil
 }
 
+func (handler *ServerHandler) handleConfigWrite() (json.RawMessage, error) {
+	handler.mutex.RLock()
+	defer handler.mutex.RUnlock()
+	config := ServerHandlerConfig{Outbox: handler.config.Outbox, Origin: handler.config.Origin, LookupSrv: handler.config.LookupSrv, Servers: []ServerConfig{}}
+	for loc, server := range handler.serverMap {
+		config.Servers = append(config.Servers, ServerConfig{Id: server.Id(), Name: server.Name(), Location: loc, Tags: server.Tags()})
+	}
+	for _, move := range handler.moving {
+		config.Servers = append(config.Servers, move.config)
+	}
+	sort.Slice(config.Servers, func(i, j int) bool { return config.Servers[i].Name < config.Servers[j].Name })
+	return json.Marshal(&config)
+}
+
+// Servers returns a snapshot of the current servers keyed by location.
 func (discord *ServerHandler) Servers() map[api.NetLocation]api.IServer {
-	return discord.ServerMap
+	discord.mutex.RLock()
+	defer discord.mutex.RUnlock()
+	servers := make(map[api.NetLocation]api.IServer, len(discord.serverMap))
+	for loc, server := range discord.serverMap {
+		servers[loc] = server
+	}
+	return servers
+}
+
+// Open starts connecting to every server, servers added afterwards connect immediately.
+func (discord *ServerHandler) Open(ctx context.Context) error {
+	discord.mutex.Lock()
+	discord.ctx = ctx
+	servers := make([]api.IServer, 0, len(discord.serverMap))
+	for _, server := range discord.serverMap {
+		servers = append(servers, server)
+	}
+	discord.mutex.Unlock()
+
+	for _, server := range servers {
+		if err := server.StartConnectLoop(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (discord *ServerHandler) AddServer(address api.NetLocation, name string) error {
-	server := NewMcServer(address, GetLocalIP(), name, discord.discordhandler.ChatInput())
-	err := server.StartConnectLoop()
+	if err := api.ValidateServerName(name); err != nil {
+		return err
+	}
+	discord.mutex.Lock()
+	err := discord.addServer(ServerConfig{Id: NewServerId(), Name: name, Location: address})
+	discord.mutex.Unlock()
 	if err != nil {
 		return err
 	}
-	discord.ServerMap[address] = server
-	fmt.Println("Added server at: ", address.Address, ":", address.Port)
 	return discord.mainconfig.Write()
 }
 
-// GetLocalIP returns the non loopback local IP of the host
+// RenameServer gives a server a new, unused name.
+func (discord *ServerHandler) RenameServer(name string, newName string) error {
+	if err := api.ValidateServerName(newName); err != nil {
+		return err
+	}
+	discord.mutex.Lock()
+	server := discord.findServer(name)
+	if server == nil {
+		discord.mutex.Unlock()
+		return fmt.Errorf("Could not find a server of name %s", name)
+	}
+	if discord.nameTaken(newName, server.Id()) {
+		discord.mutex.Unlock()
+		return fmt.Errorf("Server of name %s already exists", newName)
+	}
+	server.SetName(newName)
+	discord.mutex.Unlock()
+
+	// Handlers update settings that name the server, the write below saves them too.
+	discord.renamed(name, newName)
+	return discord.mainconfig.Write()
+}
+
+func (discord *ServerHandler) ResolveLocation(loc string) (*api.NetLocation, error) {
+	discord.mutex.RLock()
+	lookup := discord.config.LookupSrv
+	discord.mutex.RUnlock()
+	if lookup {
+		return api.ResolveNetLocation(loc)
+	}
+	return api.ParseNetLocation(loc)
+}
+
+// MoveServer reconnects a server at a new address, keeping its ID, name and tags. Packets
+// queued for it are kept only if the outbox is saved to disk. The name and both addresses
+// stay reserved while the server closes, so nothing else can take them.
+func (discord *ServerHandler) MoveServer(name string, address api.NetLocation) error {
+	discord.mutex.Lock()
+	server := discord.findServer(name)
+	if server == nil {
+		discord.mutex.Unlock()
+		return fmt.Errorf("Could not find a server of name %s", name)
+	}
+	if discord.addressTaken(address, server.Id()) {
+		discord.mutex.Unlock()
+		return fmt.Errorf("Server at address %s already exists", address)
+	}
+	old := server.Location()
+	config := ServerConfig{Id: server.Id(), Name: server.Name(), Location: address, Tags: server.Tags()}
+	delete(discord.serverMap, old)
+	discord.moving[config.Id] = moveReservation{config: config, from: old}
+	discord.mutex.Unlock()
+
+	closeServer(server)
+	discord.mutex.Lock()
+	delete(discord.moving, config.Id)
+	err := discord.addServer(config)
+	if err != nil {
+		// The server could not start at the new address, bring it back where it was.
+		config.Location = old
+		if restoreErr := discord.addServer(config); restoreErr != nil {
+			fmt.Println("Error restoring moved server,", restoreErr)
+		}
+	}
+	discord.mutex.Unlock()
+	// A config write during the move saved the new address, so a failed move is written too.
+	if writeErr := discord.mainconfig.Write(); err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+func (discord *ServerHandler) AddRenameHandler(handler api.RenameHandler) {
+	discord.mutex.Lock()
+	defer discord.mutex.Unlock()
+	discord.renamehandlers = append(discord.renamehandlers, handler)
+}
+
+func (discord *ServerHandler) renamed(oldName string, newName string) {
+	discord.mutex.RLock()
+	handlers := discord.renamehandlers
+	discord.mutex.RUnlock()
+	fmt.Println("Renamed server", oldName, "to", newName)
+	for _, handler := range handlers {
+		handler(oldName, newName)
+	}
+}
+
+// findServer must be called with the mutex held.
+func (discord *ServerHandler) findServer(name string) api.IServer {
+	for _, server := range discord.serverMap {
+		if server.Name() == name {
+			return server
+		}
+	}
+	return nil
+}
+
+// nameTaken reports whether a server other than id has or is moving with name, it must be
+// called with the mutex held.
+func (discord *ServerHandler) nameTaken(name string, id string) bool {
+	if discord.findServer(name) != nil {
+		return true
+	}
+	for moving, move := range discord.moving {
+		if moving != id && move.config.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addressTaken reports whether a server other than id is at or moving from or to address,
+// it must be called with the mutex held.
+func (discord *ServerHandler) addressTaken(address api.NetLocation, id string) bool {
+	if _, ok := discord.serverMap[address]; ok {
+		return true
+	}
+	for moving, move := range discord.moving {
+		if moving != id && (move.from == address || move.config.Location == address) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetServerTags replaces the groups of the named server, no tags takes it out of every group.
+func (discord *ServerHandler) SetServerTags(name string, tags []string) error {
+	for _, tag := range tags {
+		if err := api.ValidateTag(tag); err != nil {
+			return err
+		}
+	}
+	discord.mutex.RLock()
+	var target api.IServer
+	for _, server := range discord.serverMap {
+		if server.Name() == name {
+			target = server
+		}
+	}
+	discord.mutex.RUnlock()
+	if target == nil {
+		return fmt.Errorf("Could not find a server of name %s", name)
+	}
+	target.SetTags(tags)
+	return discord.mainconfig.Write()
+}
+
+func (discord *ServerHandler) AddStatusHandler(handler api.StatusHandler) {
+	discord.mutex.Lock()
+	defer discord.mutex.Unlock()
+	discord.statushandlers = append(discord.statushandlers, handler)
+}
+
+func (discord *ServerHandler) handleStatus(server api.IServer, status api.McServerData) {
+	discord.mutex.RLock()
+	handlers := discord.statushandlers
+	discord.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(server, status)
+	}
+}
+
+// addServer must be called with the mutex held.
+func (discord *ServerHandler) addServer(config ServerConfig) error {
+	address := config.Location
+	if discord.addressTaken(address, config.Id) {
+		return fmt.Errorf("Server at address %s already exists", address)
+	}
+	if discord.nameTaken(config.Name, config.Id) {
+		return fmt.Errorf("Server of name %s already exists", config.Name)
+	}
+	origin := discord.config.Origin
+	if origin == "" {
+		origin = GetLocalIP()
+	}
+	server := NewMcServer(address, origin, config.Id, config.Name, discord.config.Outbox, discord.discordhandler.ChatInput(), discord.handleStatus)
+	server.SetTags(config.Tags)
+	if discord.ctx != nil {
+		err := server.StartConnectLoop(discord.ctx)
+		if err != nil {
+			return err
+		}
+	}
+	discord.serverMap[address] = server
+	fmt.Println("Added server at:", address)
+	return nil
+}
+
+// GetLocalIP guesses an address of the host for servers.origin when it is not set, an IPv4
+// address if there is one, otherwise a global IPv6 one.
 func GetLocalIP() string {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return ""
 	}
+	var fallback string
 	for _, address := range addrs {
-		// check the address type and if it is not a loopback the display it
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP.String()
+		}
+		if fallback == "" {
+			fallback = ipnet.IP.String()
 		}
 	}
-	return ""
+	return fallback
 }
 
-func (discord *ServerHandler) Close() []error {
+// Close closes every server concurrently, each flushing what it can before ctx expires.
+func (discord *ServerHandler) Close(ctx context.Context) []error {
+	discord.mutex.Lock()
+	servers := discord.serverMap
+	discord.serverMap = make(map[api.NetLocation]api.IServer)
+	discord.mutex.Unlock()
+
+	errchan := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server api.IServer) {
+			defer wg.Done()
+			if err := server.Close(ctx); err != nil {
+				errchan <- err
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(errchan)
+
 	var errors []error
-	for _, server := range discord.ServerMap {
-		err := server.Close()
-		if err != nil {
-			errors = append(errors, err)
-		}
+	for err := range errchan {
+		errors = append(errors, err)
 	}
 	return errors
 }
 
+// closeServer closes a single removed server without holding up the caller indefinitely.
+func closeServer(server api.IServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), RemoveTimeout)
+	defer cancel()
+	if err := server.Close(ctx); err != nil {
+		fmt.Println("Error closing server,", err)
+	}
+}
+
+// removeServer closes a server taken out of serverMap for good and deletes its saved outbox,
+// which nothing would load again.
+func (discord *ServerHandler) removeServer(server api.IServer) {
+	closeServer(server)
+	discord.mutex.RLock()
+	config := discord.config.Outbox
+	discord.mutex.RUnlock()
+	removeOutboxFile(config, server.Id())
+}
+
 func (discord *ServerHandler) RemoveServer(address api.NetLocation) error {
-	server, ok := discord.ServerMap[address]
+	discord.mutex.Lock()
+	server, ok := discord.serverMap[address]
 	if !ok {
-		return fmt.Errorf("Could not find server of address %s:%d", address.Address, address.Port)
+		discord.mutex.Unlock()
+		return fmt.Errorf("Could not find server of address %s", address)
 	}
-	server.Close()
-	delete(discord.ServerMap, address)
-	return nil
+	delete(discord.serverMap, address)
+	discord.mutex.Unlock()
+
+	discord.removeServer(server)
+	return discord.mainconfig.Write()
 }
 
 func (discord *ServerHandler) RemoveServerByName(name string) error {
-	for loc, server := range discord.ServerMap {
+	discord.mutex.Lock()
+	for loc, server := range discord.serverMap {
 		if server.Name() == name {
-			server.Close()
-			delete(discord.ServerMap, loc)
-			return nil
+			delete(discord.serverMap, loc)
+			discord.mutex.Unlock()
+
+			discord.removeServer(server)
+			return discord.mainconfig.Write()
 		}
 	}
+	discord.mutex.Unlock()
 	return fmt.Errorf("Could not find a server of name %s", name)
 }
 
-func (handler *ServerHandler) SendPacketToAllServers(header api.Header) {
-	for loc, server := range handler.ServerMap {
+// SendPacketToAllServers sends header to every server, waiting for the deliveries
+// concurrently so a hung server cannot hold up the rest.
+func (handler *ServerHandler) SendPacketToAllServers(header api.Header) api.DeliverySummary {
+	_, wait := handler.QueuePacketToAllServers(header)
+	return wait()
+}
+
+// SendPacketToServers delivers header to the servers named by targets, either by name or as
+// group:<tag>. Targets that match no server are ignored.
+func (handler *ServerHandler) SendPacketToServers(header api.Header, targets []string) api.DeliverySummary {
+	_, wait := handler.QueuePacketToServers(header, targets)
+	return wait()
+}
+
+func (handler *ServerHandler) QueuePacketToAllServers(header api.Header) (api.DeliverySummary, api.PendingSummary) {
+	return queuePacket(header, handler.Servers())
+}
+
+func (handler *ServerHandler) QueuePacketToServers(header api.Header, targets []string) (api.DeliverySummary, api.PendingSummary) {
+	servers := handler.Servers()
+	for loc, server := range servers {
+		if !matchesAny(server, targets) {
+			delete(servers, loc)
+		}
+	}
+	return queuePacket(header, servers)
+}
+
+func matchesAny(server api.IServer, targets []string) bool {
+	tags := server.Tags()
+	for _, target := range targets {
+		if api.MatchesTarget(server.Name(), tags, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// queuePacket hands header to the outbox of every server without waiting, the returned
+// PendingSummary waits for the deliveries concurrently, so one slow server cannot hold up the rest.
+func queuePacket(header api.Header, servers map[api.NetLocation]api.IServer) (api.DeliverySummary, api.PendingSummary) {
+	var summary api.DeliverySummary
+	pending := make(map[int]api.PendingDelivery)
+	for loc, server := range servers {
 		fmt.Println("Broadcasting message of type:", header.Type, " to server:", loc.Address)
-		server.JsonChan() <- header
+		result := api.DeliveryResult{Location: loc, Id: server.Id(), Name: server.Name(), Status: api.Queued}
+		if wait, err := server.Queue(header); err != nil {
+			fmt.Println("Error broadcasting to server,", err)
+			result.Status, result.Err = api.Dropped, err
+		} else {
+			pending[len(summary.Results)] = wait
+		}
+		summary.Results = append(summary.Results, result)
+	}
+	return summary, func() api.DeliverySummary {
+		delivered := api.DeliverySummary{Results: append([]api.DeliveryResult(nil), summary.Results...)}
+		var wg sync.WaitGroup
+		for i, wait := range pending {
+			wg.Add(1)
+			go func(i int, wait api.PendingDelivery) {
+				defer wg.Done()
+				delivered.Results[i].Status = wait()
+			}(i, wait)
+		}
+		wg.Wait()
+		return delivered
 	}
 }
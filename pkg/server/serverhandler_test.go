@@ -0,0 +1,253 @@
+package server // "github.com/itszuvalex/mcdiscord/pkg/server"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+)
+
+// memoryConfig keeps the config in memory, calling handlers under its lock as the file config does.
+type memoryConfig struct {
+	api.IConfig
+	read  map[string]api.ConfigReadHandler
+	write map[string]api.ConfigWriteHandler
+	data  map[string]json.RawMessage
+	mutex sync.Mutex
+}
+
+func newMemoryConfig() *memoryConfig {
+	return &memoryConfig{
+		read:  make(map[string]api.ConfigReadHandler),
+		write: make(map[string]api.ConfigWriteHandler),
+		data:  make(map[string]json.RawMessage),
+	}
+}
+
+func (config *memoryConfig) AddReadHandler(key string, handler api.ConfigReadHandler) {
+	config.read[key] = handler
+}
+
+func (config *memoryConfig) AddWriteHandler(key string, handler api.ConfigWriteHandler) {
+	config.write[key] = handler
+}
+
+func (config *memoryConfig) AddValidateHandler(key string, handler api.ConfigValidateHandler) {}
+
+func (config *memoryConfig) AddOption(option api.ConfigOption) {}
+
+func (config *memoryConfig) Write() error {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	for key, handler := range config.write {
+		data, err := handler()
+		if err != nil {
+			return err
+		}
+		config.data[key] = data
+	}
+	return nil
+}
+
+func (config *memoryConfig) Read() error {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	for key, handler := range config.read {
+		if data, ok := config.data[key]; ok {
+			if err := handler(data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// chatDiscord is the part of the Discord handler the server handler uses.
+type chatDiscord struct {
+	api.IDiscordHandler
+	input chan api.MessageWithSender
+}
+
+func (discord *chatDiscord) ChatInput() chan api.MessageWithSender {
+	return discord.input
+}
+
+func newTestHandler() (*ServerHandler, *memoryConfig) {
+	config := newMemoryConfig()
+	handler := NewServerHandler(config, &chatDiscord{input: make(chan api.MessageWithSender, 100)}).(*ServerHandler)
+	return handler, config
+}
+
+func testHeader(t *testing.T) api.Header {
+	var header api.Header
+	command := api.Command{Command: "say hello", Source: "test"}
+	if err := api.MarshalCommandToHeader(&command, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+// TestConcurrentAccess hammers the registry from several goroutines, run it with -race.
+func TestConcurrentAccess(t *testing.T) {
+	handler, config := newTestHandler()
+	header := testHeader(t)
+
+	const workers = 8
+	const rounds = 25
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				name := fmt.Sprintf("server-%d-%d", w, i)
+				location := api.NetLocation{Address: "127.0.0.1", Port: 20000 + w*rounds + i}
+				if err := handler.AddServer(location, name); err != nil {
+					t.Error(err)
+					continue
+				}
+				handler.SendPacketToAllServers(header)
+				handler.SendPacketToServers(header, []string{name})
+				for loc, server := range handler.Servers() {
+					if server.Location() != loc {
+						t.Errorf("server %s listed at %s", server.Location(), loc)
+					}
+				}
+				// A concurrent config read may have taken the server out already.
+				handler.RemoveServerByName(name)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if err := config.Write(); err != nil {
+				t.Error(err)
+			}
+			if err := config.Read(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Whatever a config read re-added is still removable, leaving an empty registry.
+	for _, server := range handler.Servers() {
+		if err := handler.RemoveServerByName(server.Name()); err != nil {
+			t.Error(err)
+		}
+	}
+	if n := len(handler.Servers()); n != 0 {
+		t.Errorf("%d servers left after removing all", n)
+	}
+}
+
+func TestAddServerRejectsInvalid(t *testing.T) {
+	handler, _ := newTestHandler()
+	location := api.NetLocation{Address: "127.0.0.1", Port: 25575}
+	if err := handler.AddServer(location, "survival"); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.AddServer(location, "creative"); err == nil {
+		t.Error("added a second server at the same address")
+	}
+	if err := handler.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25576}, "survival"); err == nil {
+		t.Error("added a second server of the same name")
+	}
+	if err := handler.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25577}, "group:modded"); err == nil {
+		t.Error("added a server named like a group")
+	}
+	if err := handler.RenameServer("survival", "group:modded"); err == nil {
+		t.Error("renamed a server to a group name")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if errs := handler.Close(ctx); len(errs) > 0 {
+		t.Error(errs)
+	}
+}
+
+func TestMoveReservesNameAndAddress(t *testing.T) {
+	handler, config := newTestHandler()
+	from := api.NetLocation{Address: "127.0.0.1", Port: 25575}
+	to := api.NetLocation{Address: "127.0.0.1", Port: 25576}
+	// A server in the middle of a move is out of serverMap but holds its name and both addresses.
+	handler.moving["moving"] = moveReservation{config: ServerConfig{Id: "moving", Name: "survival", Location: to}, from: from}
+
+	if err := handler.AddServer(from, "creative"); err == nil {
+		t.Error("added a server at the address a server is moving from")
+	}
+	if err := handler.AddServer(to, "creative"); err == nil {
+		t.Error("added a server at the address a server is moving to")
+	}
+	if err := handler.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25577}, "survival"); err == nil {
+		t.Error("added a server with the name of a moving server")
+	}
+	if err := handler.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25577}, "lobby"); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.RenameServer("lobby", "survival"); err == nil {
+		t.Error("renamed a server to the name of a moving server")
+	}
+
+	// The moving server stays in the config, and a config read leaves adding it to the move.
+	if err := config.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handler.Servers()[to]; ok {
+		t.Error("config read added a server that is being moved")
+	}
+	var saved ServerHandlerConfig
+	if err := json.Unmarshal(config.data[ConfigKey], &saved); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Servers) != 2 {
+		t.Errorf("config has %d servers, want the moving one too", len(saved.Servers))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if errs := handler.Close(ctx); len(errs) > 0 {
+		t.Error(errs)
+	}
+}
+
+func TestRemoveServerDeletesOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	handler, _ := newTestHandler()
+	handler.config.Outbox.Dir = dir
+	if err = handler.AddServer(api.NetLocation{Address: "127.0.0.1", Port: 25575}, "survival"); err != nil {
+		t.Fatal(err)
+	}
+	handler.mutex.RLock()
+	server := handler.findServer("survival")
+	handler.mutex.RUnlock()
+	if _, err = server.Queue(testHeader(t)); err != nil {
+		t.Fatal(err)
+	}
+	file := outboxFile(handler.config.Outbox, server.Id())
+	if _, err = os.Stat(file); err != nil {
+		t.Fatal("queued packet was not saved,", err)
+	}
+	if err = handler.RemoveServerByName("survival"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Error("outbox file of a removed server is still there")
+	}
+}
@@ -0,0 +1,325 @@
+package sessions // "github.com/itszuvalex/mcdiscord/pkg/sessions"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itszuvalex/mcdiscord/pkg/api"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	FileName    = "sessions.db"
+	OpenTimeout = 2 * time.Second
+	// StaleAfter ends a server's sessions if it has not pushed a status for this long,
+	// so a bot or server outage is not counted as playtime.
+	StaleAfter = 5 * time.Minute
+)
+
+var (
+	sessionBucket = []byte("sessions")
+	metaBucket    = []byte("meta")
+	// adoptedKey is set once sessions name servers by ID.
+	adoptedKey = []byte("serverIds")
+)
+
+var _ api.IPlayerSessions = (*Tracker)(nil)
+
+type session struct {
+	Player string    `json:"player"`
+	Server string    `json:"server"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+type serverState struct {
+	online   map[string]time.Time
+	lastSeen time.Time
+}
+
+func (state *serverState) stale(now time.Time) bool {
+	return now.Sub(state.lastSeen) > StaleAfter
+}
+
+// end is when the server's open sessions end if they were ended at now.
+func (state *serverState) end(now time.Time) time.Time {
+	if state.stale(now) {
+		return state.lastSeen
+	}
+	return now
+}
+
+// Tracker diffs successive player lists per server. Finished sessions are stored in a bolt
+// database, open ones are kept in memory and counted as lasting until now.
+type Tracker struct {
+	db      *bolt.DB
+	servers map[string]*serverState
+	mutex   sync.Mutex
+}
+
+func Open(file string) (*Tracker, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(sessionBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Tracker{db: db, servers: make(map[string]*serverState)}, nil
+}
+
+// Update records the players online on server at now, ending sessions of players who are gone.
+func (tracker *Tracker) Update(server string, players []string, now time.Time) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	state, ok := tracker.servers[server]
+	if !ok {
+		state = &serverState{online: make(map[string]time.Time)}
+		tracker.servers[server] = state
+	}
+
+	var ended []session
+	if !state.lastSeen.IsZero() && state.stale(now) {
+		for player, start := range state.online {
+			ended = append(ended, session{Player: player, Server: server, Start: start, End: state.lastSeen})
+			delete(state.online, player)
+		}
+	}
+
+	present := make(map[string]bool, len(players))
+	for _, player := range players {
+		present[player] = true
+		if _, ok := state.online[player]; !ok {
+			state.online[player] = now
+		}
+	}
+	for player, start := range state.online {
+		if !present[player] {
+			ended = append(ended, session{Player: player, Server: server, Start: start, End: now})
+			delete(state.online, player)
+		}
+	}
+	state.lastSeen = now
+	return tracker.store(ended)
+}
+
+func (tracker *Tracker) store(sessions []session) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	return tracker.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionBucket)
+		for _, s := range sessions {
+			data, err := json.Marshal(&s)
+			if err != nil {
+				return err
+			}
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 16)
+			binary.BigEndian.PutUint64(key, uint64(s.End.UnixNano()))
+			binary.BigEndian.PutUint64(key[8:], seq)
+			if err = bucket.Put(key, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close ends every open session and closes the database.
+func (tracker *Tracker) Close() error {
+	tracker.mutex.Lock()
+	var ended []session
+	for server, state := range tracker.servers {
+		for player, start := range state.online {
+			ended = append(ended, session{Player: player, Server: server, Start: start, End: state.lastSeen})
+		}
+	}
+	tracker.servers = make(map[string]*serverState)
+	err := tracker.store(ended)
+	tracker.mutex.Unlock()
+
+	if closeErr := tracker.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// each calls visit with every session ending at or after since, open ones ending now.
+func (tracker *Tracker) each(since time.Time, visit func(s session)) error {
+	now := time.Now()
+	tracker.mutex.Lock()
+	for server, state := range tracker.servers {
+		for player, start := range state.online {
+			visit(session{Player: player, Server: server, Start: start, End: state.end(now)})
+		}
+	}
+	tracker.mutex.Unlock()
+
+	from := make([]byte, 8)
+	if !since.IsZero() {
+		binary.BigEndian.PutUint64(from, uint64(since.UnixNano()))
+	}
+	return tracker.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(sessionBucket).Cursor()
+		for key, value := cursor.Seek(from); key != nil; key, value = cursor.Next() {
+			var s session
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			visit(s)
+		}
+		return nil
+	})
+}
+
+// length is the part of a session after since.
+func length(s session, since time.Time) time.Duration {
+	start := s.Start
+	if start.Before(since) {
+		start = since
+	}
+	if s.End.Before(start) {
+		return 0
+	}
+	return s.End.Sub(start)
+}
+
+func (tracker *Tracker) Playtime(player string, since time.Time) ([]api.PlayerTime, error) {
+	totals := make(map[string]*api.PlayerTime)
+	err := tracker.each(since, func(s session) {
+		if !strings.EqualFold(s.Player, player) {
+			return
+		}
+		total, ok := totals[s.Server]
+		if !ok {
+			total = &api.PlayerTime{Player: s.Player, Server: s.Server}
+			totals[s.Server] = total
+		}
+		total.Time += length(s, since)
+	})
+	return sortTimes(totals, 0), err
+}
+
+func (tracker *Tracker) Top(server string, since time.Time, n int, filter func(server string) bool) ([]api.PlayerTime, error) {
+	totals := make(map[string]*api.PlayerTime)
+	err := tracker.each(since, func(s session) {
+		if (server != "" && s.Server != server) || (filter != nil && !filter(s.Server)) {
+			return
+		}
+		total, ok := totals[s.Player]
+		if !ok {
+			total = &api.PlayerTime{Player: s.Player, Server: server}
+			totals[s.Player] = total
+		}
+		total.Time += length(s, since)
+	})
+	return sortTimes(totals, n), err
+}
+
+func sortTimes(totals map[string]*api.PlayerTime, n int) []api.PlayerTime {
+	times := make([]api.PlayerTime, 0, len(totals))
+	for _, total := range totals {
+		times = append(times, *total)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		if times[i].Time == times[j].Time {
+			return times[i].Player < times[j].Player
+		}
+		return times[i].Time > times[j].Time
+	})
+	if n > 0 && len(times) > n {
+		times = times[:n]
+	}
+	return times
+}
+
+// AdoptServerIds rewrites the server of sessions stored before servers had IDs, once.
+func (tracker *Tracker) AdoptServerIds(ids map[string]string) error {
+	return tracker.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta.Get(adoptedKey) != nil {
+			return nil
+		}
+		bucket := tx.Bucket(sessionBucket)
+		var keys [][]byte
+		var sessions []session
+		err := bucket.ForEach(func(key, value []byte) error {
+			var s session
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			if id, ok := ids[s.Server]; ok {
+				s.Server = id
+				keys = append(keys, append([]byte(nil), key...))
+				sessions = append(sessions, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, s := range sessions {
+			data, err := json.Marshal(&s)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put(keys[i], data); err != nil {
+				return err
+			}
+		}
+		return meta.Put(adoptedKey, []byte{1})
+	})
+}
+
+func (tracker *Tracker) Seen(player string, filter func(server string) bool) (*api.PlayerSeen, error) {
+	var online []api.PlayerSeen
+	tracker.mutex.Lock()
+	for server, state := range tracker.servers {
+		for name := range state.online {
+			if strings.EqualFold(name, player) {
+				online = append(online, api.PlayerSeen{Player: name, Server: server, Time: state.lastSeen, Online: !state.stale(time.Now())})
+			}
+		}
+	}
+	tracker.mutex.Unlock()
+	// filter may take other locks, so it is only called once the tracker's is released.
+	for i := range online {
+		if filter == nil || filter(online[i].Server) {
+			return &online[i], nil
+		}
+	}
+
+	var seen *api.PlayerSeen
+	err := tracker.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(sessionBucket).Cursor()
+		for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+			var s session
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			if strings.EqualFold(s.Player, player) && (filter == nil || filter(s.Server)) {
+				seen = &api.PlayerSeen{Player: s.Player, Server: s.Server, Time: s.End}
+				return nil
+			}
+		}
+		return nil
+	})
+	return seen, err
+}